@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
@@ -12,7 +13,14 @@ import (
 	"github.com/sdblg/meme/pkg/services"
 )
 
-const port = 8080
+const (
+	port = 8080
+
+	variantQueueSize = 1000
+	variantWorkers   = 2
+
+	uploadSweepInterval = time.Minute * 15
+)
 
 var Version = "development"
 
@@ -33,8 +41,115 @@ func main() {
 	flag.StringVar(&app.JWTAudience, "jwt-audience", "esusu.com", "signing audience")
 	flag.StringVar(&app.CookieDomain, "cookie-domain", "localhost", "cookie domain")
 	flag.StringVar(&app.Domain, "domain", "esusu.com", "domain")
+	flag.DurationVar(&app.TileMaxAge, "tile-max-age", time.Minute*5, "vector tile cache max-age")
+	flag.DurationVar(
+		&app.ImageURLExpiry,
+		"image-url-expiry",
+		time.Hour,
+		"how long signed image URLs of non-public memes stay valid",
+	)
+	flag.Int64Var(&app.MaxUploadBytes, "max-upload-bytes", 10<<20, "maximum size of an image upload")
+	flag.DurationVar(
+		&app.UploadExpiry,
+		"upload-expiry",
+		time.Hour*24,
+		"how long an unfinished resumable upload is kept after it was last added to",
+	)
+	flag.StringVar(
+		&app.DuplicatePolicy,
+		"duplicate-policy",
+		"flag",
+		"what to do with uploads that look like an existing meme: reject, flag or off",
+	)
+	flag.IntVar(
+		&app.DuplicateDistance,
+		"duplicate-distance",
+		5,
+		"maximum perceptual hash distance, in bits, for an upload to count as a duplicate",
+	)
+	flag.StringVar(
+		&app.WatermarkText,
+		"watermark-text",
+		"",
+		"text to watermark meme images with",
+	)
+	flag.StringVar(
+		&app.WatermarkImage,
+		"watermark-image",
+		"",
+		"image file to watermark meme images with, instead of text",
+	)
+	flag.StringVar(
+		&app.WatermarkPosition,
+		"watermark-position",
+		"bottom-right",
+		"watermark position: top-left, top-right, bottom-left, bottom-right or center",
+	)
+	flag.Float64Var(
+		&app.WatermarkOpacity,
+		"watermark-opacity",
+		0.5,
+		"watermark opacity, from 0 to 1",
+	)
+	flag.Float64Var(
+		&app.WatermarkScale,
+		"watermark-scale",
+		0.25,
+		"fraction of the image width the watermark spans",
+	)
+	flag.StringVar(&app.MailBackend, "mailer", "log", "how to send account emails: log or smtp")
+	flag.StringVar(&app.SMTPAddr, "smtp-addr", "localhost:1025", "SMTP server, for the smtp mailer")
+	flag.StringVar(&app.SMTPUsername, "smtp-username", "", "SMTP username, for the smtp mailer")
+	flag.StringVar(&app.SMTPPassword, "smtp-password", "", "SMTP password, for the smtp mailer")
+	flag.StringVar(
+		&app.MailFrom,
+		"mail-from",
+		"Memes <noreply@esusu.com>",
+		"sender of account emails",
+	)
+	flag.StringVar(
+		&app.BaseURL,
+		"base-url",
+		"http://localhost:8080",
+		"public URL of the API, for links in emails",
+	)
+	flag.StringVar(
+		&app.PasswordResetURL,
+		"password-reset-url",
+		"https://learn-code.ca/password/reset",
+		"front end page that password reset links in emails point at",
+	)
+	flag.DurationVar(
+		&app.ResetExpiry,
+		"reset-expiry",
+		time.Hour,
+		"how long password reset links stay valid",
+	)
+	flag.DurationVar(
+		&app.VerificationExpiry,
+		"verification-expiry",
+		time.Hour*48,
+		"how long email verification links stay valid",
+	)
+	flag.StringVar(&app.StorageBackend, "storage", "local", "image storage backend: local or s3")
+	flag.StringVar(
+		&app.UploadDir,
+		"upload-dir",
+		"uploads",
+		"directory images are stored in, for local storage",
+	)
+	flag.StringVar(&app.S3Endpoint, "s3-endpoint", "localhost:9000", "S3 endpoint, for s3 storage")
+	flag.StringVar(&app.S3AccessKey, "s3-access-key", "esusu", "S3 access key, for s3 storage")
+	flag.StringVar(&app.S3SecretKey, "s3-secret-key", "esusu-secret", "S3 secret key, for s3 storage")
+	flag.StringVar(&app.S3Bucket, "s3-bucket", "memes", "S3 bucket, for s3 storage")
+	flag.BoolVar(&app.S3UseSSL, "s3-use-ssl", false, "use TLS to connect to S3, for s3 storage")
 	flag.Parse()
 
+	err := app.ValidateDuplicatePolicy()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// connect to the database
 	conn, err := app.ConnectToDB()
 	if err != nil {
@@ -43,6 +158,26 @@ func main() {
 	app.DB = &dbrepo.PostgresDBRepo{DB: conn}
 	defer app.DB.Connection().Close()
 
+	app.Storage, err = app.ConnectToStorage()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app.Mailer, err = app.ConnectToMailer()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app.Variants = services.NewVariants(app.DB, app.Storage, variantQueueSize)
+	app.Variants.Watermark, err = app.LoadWatermark()
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.Variants.Run(context.Background(), variantWorkers)
+
+	app.Uploads = &services.Uploads{DB: app.DB, Storage: app.Storage}
+	app.Uploads.Run(context.Background(), uploadSweepInterval)
+
 	app.Auth = services.Auth{
 		Issuer:        app.JWTIssuer,
 		Audience:      app.JWTAudience,
@@ -54,6 +189,11 @@ func main() {
 		CookieDomain:  app.CookieDomain,
 	}
 
+	app.ImageURLs = services.URLSigner{
+		Secret: app.JWTSecret,
+		Expiry: app.ImageURLExpiry,
+	}
+
 	log.Println("Starting Application on port", port)
 
 	// start a web server
@@ -0,0 +1,238 @@
+// Command memectl runs administrative jobs against the meme database and image storage.
+//
+//	memectl [flags] variants [id ...]
+//
+// regenerates the resized image variants of the given memes, or of every meme if no ids
+// are given.
+//
+//	memectl [flags] blurhash [id ...]
+//
+// computes the BlurHash placeholders of the given memes, or of every meme that does not
+// have one yet if no ids are given.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/sdblg/meme/pkg/controllers"
+	"github.com/sdblg/meme/pkg/imaging"
+	"github.com/sdblg/meme/pkg/repository/dbrepo"
+	"github.com/sdblg/meme/pkg/services"
+)
+
+func main() {
+	var app controllers.Application
+
+	flag.StringVar(
+		&app.DSN,
+		"dsn",
+		"host=localhost port=54322 user=esusu password=esusu dbname=esusu sslmode=disable timezone=UTC connect_timeout=5",
+		"Postgres connection string",
+	)
+	flag.StringVar(
+		&app.WatermarkText,
+		"watermark-text",
+		"",
+		"text to watermark meme images with",
+	)
+	flag.StringVar(
+		&app.WatermarkImage,
+		"watermark-image",
+		"",
+		"image file to watermark meme images with, instead of text",
+	)
+	flag.StringVar(
+		&app.WatermarkPosition,
+		"watermark-position",
+		"bottom-right",
+		"watermark position: top-left, top-right, bottom-left, bottom-right or center",
+	)
+	flag.Float64Var(
+		&app.WatermarkOpacity,
+		"watermark-opacity",
+		0.5,
+		"watermark opacity, from 0 to 1",
+	)
+	flag.Float64Var(
+		&app.WatermarkScale,
+		"watermark-scale",
+		0.25,
+		"fraction of the image width the watermark spans",
+	)
+	flag.StringVar(&app.StorageBackend, "storage", "local", "image storage backend: local or s3")
+	flag.StringVar(
+		&app.UploadDir,
+		"upload-dir",
+		"uploads",
+		"directory images are stored in, for local storage",
+	)
+	flag.StringVar(&app.S3Endpoint, "s3-endpoint", "localhost:9000", "S3 endpoint, for s3 storage")
+	flag.StringVar(&app.S3AccessKey, "s3-access-key", "esusu", "S3 access key, for s3 storage")
+	flag.StringVar(&app.S3SecretKey, "s3-secret-key", "esusu-secret", "S3 secret key, for s3 storage")
+	flag.StringVar(&app.S3Bucket, "s3-bucket", "memes", "S3 bucket, for s3 storage")
+	flag.BoolVar(&app.S3UseSSL, "s3-use-ssl", false, "use TLS to connect to S3, for s3 storage")
+	flag.Usage = func() {
+		fmt.Fprintf(
+			flag.CommandLine.Output(),
+			"Usage: memectl [flags] variants [id ...]\n       memectl [flags] blurhash [id ...]\n\n",
+		)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	conn, err := app.ConnectToDB()
+	if err != nil {
+		log.Fatal(err)
+	}
+	app.DB = &dbrepo.PostgresDBRepo{DB: conn}
+	defer app.DB.Connection().Close()
+
+	app.Storage, err = app.ConnectToStorage()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch flag.Arg(0) {
+	case "variants":
+		err = regenerateVariants(&app, flag.Args()[1:])
+	case "blurhash":
+		err = backfillBlurHashes(&app, flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// regenerateVariants regenerates the resized variants of the memes with the given ids, or
+// of every meme if ids is empty. It carries on past failures and reports how many there
+// were at the end.
+func regenerateVariants(app *controllers.Application, ids []string) error {
+	memeIDs, err := memeIDs(app, ids)
+	if err != nil {
+		return err
+	}
+
+	variants := services.NewVariants(app.DB, app.Storage, 0)
+	variants.Watermark, err = app.LoadWatermark()
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, id := range memeIDs {
+		err := variants.Generate(context.Background(), id)
+		if err != nil {
+			log.Printf("meme %d: %v", id, err)
+			failed++
+			continue
+		}
+		log.Printf("meme %d: variants regenerated", id)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d memes failed", failed, len(memeIDs))
+	}
+
+	return nil
+}
+
+// backfillBlurHashes computes the BlurHash placeholders of the memes with the given ids,
+// or of every meme without one if ids is empty. Like regenerateVariants, it carries on
+// past failures.
+func backfillBlurHashes(app *controllers.Application, ids []string) error {
+	var memeIDs []int
+	var err error
+
+	if len(ids) == 0 {
+		memeIDs, err = app.DB.MemeIDsWithoutBlurHash()
+	} else {
+		memeIDs, err = parseMemeIDs(ids)
+	}
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, id := range memeIDs {
+		err := updateBlurHash(app, id)
+		if err != nil {
+			log.Printf("meme %d: %v", id, err)
+			failed++
+			continue
+		}
+		log.Printf("meme %d: blurhash updated", id)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d memes failed", failed, len(memeIDs))
+	}
+
+	return nil
+}
+
+// updateBlurHash computes the BlurHash of one meme from its stored image, which is
+// already upright, and saves it.
+func updateBlurHash(app *controllers.Application, id int) error {
+	meme, err := app.DB.OneMeme(id)
+	if err != nil {
+		return err
+	}
+
+	key := meme.ImageKey()
+
+	blob, err := app.Storage.Get(context.Background(), key)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", key, err)
+	}
+	data, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", key, err)
+	}
+
+	img, _, err := imaging.Decode(data)
+	if err != nil {
+		return fmt.Errorf("decoding %s: %w", key, err)
+	}
+
+	return app.DB.UpdateMemeBlurHash(id, imaging.BlurHash(img))
+}
+
+// memeIDs parses ids, or lists every meme in the database if there are none.
+func memeIDs(app *controllers.Application, ids []string) ([]int, error) {
+	if len(ids) == 0 {
+		return app.DB.AllMemeIDs()
+	}
+
+	return parseMemeIDs(ids)
+}
+
+// parseMemeIDs parses meme ids given on the command line.
+func parseMemeIDs(ids []string) ([]int, error) {
+	var memeIDs []int
+
+	for _, id := range ids {
+		memeID, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid meme id %q", id)
+		}
+		memeIDs = append(memeIDs, memeID)
+	}
+
+	return memeIDs, nil
+}
@@ -0,0 +1,311 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sdblg/meme/pkg/models"
+	"github.com/sdblg/meme/pkg/services"
+	"github.com/sdblg/meme/pkg/utils"
+)
+
+// mailTimeout is how long sending an email in the background may take.
+const mailTimeout = time.Second * 30
+
+// Register creates a member account from a JSON payload with first_name, last_name, email
+// and password, and emails a link to verify the address; the account cannot log in until
+// it is followed. Registering again before then replaces the name and sends a new link;
+// each link sets the password it was registered with, and the first one followed wins.
+// The response is the same whether or not the address already has a verified account,
+// which is left alone, so that it does not reveal who has one.
+func (app *Application) Register(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Email     string `json:"email"`
+		Password  string `json:"password"`
+	}
+
+	err := utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	email, err := models.NormalizeEmail(payload.Email)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	user := models.User{
+		FirstName: strings.TrimSpace(payload.FirstName),
+		LastName:  strings.TrimSpace(payload.LastName),
+		Email:     email,
+		Role:      models.RoleMember,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	err = user.Validate()
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	err = user.SetPassword(payload.Password)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: "check your email for a link to verify your address",
+	}
+
+	user.ID, err = app.DB.RegisterUser(user)
+	if errors.Is(err, sql.ErrNoRows) {
+		_ = utils.WriteJSON(w, http.StatusAccepted, resp)
+		return
+	}
+	if err != nil {
+		_ = utils.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	link, err := app.tokenLink(
+		user.ID,
+		models.TokenVerifyEmail,
+		app.VerificationExpiry,
+		user.Password,
+		strings.TrimSuffix(app.BaseURL, "/")+"/verify-email",
+	)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	// The mail is sent in the background, as ForgotPassword does, so that new addresses
+	// take no longer to answer than ones that already have an account.
+	app.sendMailLater(services.Mail{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nFollow this link to verify your email address and finish "+
+				"registering:\n\n%s\n\nThe link works for %s. If you did not register, "+
+				"you can ignore this email.\n",
+			user.FirstName,
+			link,
+			formatDuration(app.VerificationExpiry),
+		),
+	})
+
+	_ = utils.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// VerifyEmail follows the link emailed by Register, and verifies the account's email
+// address so that it can log in. Each link works once, until it expires.
+func (app *Application) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		_ = utils.ErrorJSON(w, errors.New("token is required"))
+		return
+	}
+
+	err := app.DB.VerifyEmail(models.HashUserToken(token))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			_ = utils.ErrorJSON(w, errors.New("the link is invalid or has expired"))
+			return
+		}
+		_ = utils.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: "email address verified, you can now log in",
+	}
+
+	_ = utils.WriteJSON(w, http.StatusOK, resp)
+}
+
+// ForgotPassword emails a link to reset the password of the account with the email
+// address in a JSON payload such as {"email": "jane@example.com"}. The response is the same
+// whether or not there is such an account, and the email is sent in the background so
+// that the response time does not tell either.
+func (app *Application) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+
+	err := utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	email, err := models.NormalizeEmail(payload.Email)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: "if the address has an account, a password reset link has been sent to it",
+	}
+
+	user, err := app.DB.GetUserByEmail(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		_ = utils.WriteJSON(w, http.StatusAccepted, resp)
+		return
+	}
+	if err != nil {
+		_ = utils.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	link, err := app.tokenLink(
+		user.ID,
+		models.TokenResetPassword,
+		app.ResetExpiry,
+		"",
+		app.PasswordResetURL,
+	)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	app.sendMailLater(services.Mail{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nFollow this link to choose a new password:\n\n%s\n\n"+
+				"The link works once, for %s. If you did not ask to reset your password, "+
+				"you can ignore this email; your password has not been changed.\n",
+			user.FirstName,
+			link,
+			formatDuration(app.ResetExpiry),
+		),
+	})
+
+	_ = utils.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// ResetPassword sets a new password from a JSON payload with the token from the link
+// emailed by ForgotPassword and the password. Each link works once, until it expires, and
+// a reset logs the user out everywhere else by invalidating their refresh tokens.
+func (app *Application) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	err := utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	if payload.Token == "" {
+		_ = utils.ErrorJSON(w, errors.New("token is required"))
+		return
+	}
+
+	var user models.User
+
+	err = user.SetPassword(payload.Password)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	err = app.DB.ResetPassword(models.HashUserToken(payload.Token), user.Password)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			_ = utils.ErrorJSON(w, errors.New("the link is invalid or has expired"))
+			return
+		}
+		_ = utils.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: "password reset, you can now log in",
+	}
+
+	_ = utils.WriteJSON(w, http.StatusOK, resp)
+}
+
+// sendMailLater sends mail in the background, logging any failure.
+func (app *Application) sendMailLater(mail services.Mail) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+		defer cancel()
+
+		err := app.Mailer.Send(ctx, mail)
+		if err != nil {
+			log.Printf("mail to %s: %v", mail.To, err)
+		}
+	}()
+}
+
+// tokenLink stores a new user token with the given purpose, lifetime and, for email
+// verification, password hash, and returns link with the token's secret added in a token
+// query parameter.
+func (app *Application) tokenLink(
+	userID int,
+	purpose string,
+	ttl time.Duration,
+	password string,
+	link string,
+) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+
+	secret, token, err := models.NewUserToken(userID, purpose, ttl)
+	if err != nil {
+		return "", err
+	}
+	token.Password = password
+
+	err = app.DB.InsertUserToken(token)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Set("token", secret)
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// formatDuration formats d for people, in whole days, hours or minutes.
+func formatDuration(d time.Duration) string {
+	n, unit := int(d/time.Minute), "minute"
+	switch {
+	case d >= 24*time.Hour && d%(24*time.Hour) == 0:
+		n, unit = int(d/(24*time.Hour)), "day"
+	case d >= time.Hour && d%time.Hour == 0:
+		n, unit = int(d/time.Hour), "hour"
+	}
+
+	if n != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s", n, unit)
+}
@@ -2,9 +2,16 @@ package controllers
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
+	"image"
 	"log"
+	"os"
+	"time"
 
+	"github.com/sdblg/meme/pkg/imaging"
 	"github.com/sdblg/meme/pkg/repository"
+	"github.com/sdblg/meme/pkg/repository/blobrepo"
 	"github.com/sdblg/meme/pkg/services"
 )
 
@@ -12,11 +19,56 @@ type Application struct {
 	DSN          string
 	Domain       string
 	DB           repository.DatabaseRepo
+	Storage      repository.BlobStorage
+	Variants     *services.Variants
+	Uploads      *services.Uploads
 	Auth         services.Auth
 	JWTSecret    string
 	JWTIssuer    string
 	JWTAudience  string
 	CookieDomain string
+	TileMaxAge   time.Duration
+
+	// ImageURLs signs the image paths of memes that are not public.
+	ImageURLs      services.URLSigner
+	ImageURLExpiry time.Duration
+
+	MaxUploadBytes int64
+
+	// UploadExpiry is how long a resumable upload is kept after it was last added to.
+	UploadExpiry time.Duration
+
+	DuplicatePolicy   string
+	DuplicateDistance int
+
+	// The watermark drawn on image variants: either text or an image file, or neither.
+	WatermarkText     string
+	WatermarkImage    string
+	WatermarkPosition string
+	WatermarkOpacity  float64
+	WatermarkScale    float64
+
+	// Mailer sends account emails, as selected by MailBackend: "log" or "smtp". Email
+	// verification links point at BaseURL, the API's public URL, and password reset links
+	// at PasswordResetURL, the front end's page for choosing a new password.
+	Mailer             services.Mailer
+	MailBackend        string
+	MailFrom           string
+	SMTPAddr           string
+	SMTPUsername       string
+	SMTPPassword       string
+	BaseURL            string
+	PasswordResetURL   string
+	VerificationExpiry time.Duration
+	ResetExpiry        time.Duration
+
+	StorageBackend string
+	UploadDir      string
+	S3Endpoint     string
+	S3AccessKey    string
+	S3SecretKey    string
+	S3Bucket       string
+	S3UseSSL       bool
 }
 
 func (app *Application) ConnectToDB() (*sql.DB, error) {
@@ -28,3 +80,89 @@ func (app *Application) ConnectToDB() (*sql.DB, error) {
 	log.Println("Connected to Postgres!")
 	return connection, nil
 }
+
+// ConnectToStorage returns the blob storage selected by app.StorageBackend: "local" keeps
+// images in app.UploadDir, and "s3" keeps them in an S3-compatible bucket.
+func (app *Application) ConnectToStorage() (repository.BlobStorage, error) {
+	switch app.StorageBackend {
+	case "local":
+		log.Println("Storing images in", app.UploadDir)
+		return &blobrepo.LocalBlobRepo{Dir: app.UploadDir}, nil
+	case "s3":
+		client, err := services.OpenS3(
+			app.S3Endpoint,
+			app.S3AccessKey,
+			app.S3SecretKey,
+			app.S3Bucket,
+			app.S3UseSSL,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Println("Connected to S3 bucket", app.S3Bucket)
+		return &blobrepo.S3BlobRepo{Client: client, Bucket: app.S3Bucket}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", app.StorageBackend)
+	}
+}
+
+// ConnectToMailer returns the mailer selected by app.MailBackend: "log" writes emails to
+// the log, and "smtp" sends them through the SMTP server at app.SMTPAddr.
+func (app *Application) ConnectToMailer() (services.Mailer, error) {
+	switch app.MailBackend {
+	case "log":
+		log.Println("Logging emails instead of sending them")
+		return services.LogMailer{}, nil
+	case "smtp":
+		log.Println("Sending emails through", app.SMTPAddr)
+		return &services.SMTPMailer{
+			Addr:     app.SMTPAddr,
+			Username: app.SMTPUsername,
+			Password: app.SMTPPassword,
+			From:     app.MailFrom,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail backend %q", app.MailBackend)
+	}
+}
+
+// LoadWatermark returns the watermark configured by app.WatermarkText or
+// app.WatermarkImage, or nil if there is none.
+func (app *Application) LoadWatermark() (*imaging.Watermark, error) {
+	var img image.Image
+	var err error
+
+	switch {
+	case app.WatermarkText != "" && app.WatermarkImage != "":
+		return nil, errors.New("watermark text and image cannot both be set")
+	case app.WatermarkText != "":
+		img, err = imaging.TextWatermark(app.WatermarkText)
+	case app.WatermarkImage != "":
+		var data []byte
+		data, err = os.ReadFile(app.WatermarkImage)
+		if err == nil {
+			img, _, err = imaging.Decode(data)
+		}
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loading watermark: %w", err)
+	}
+
+	wm := &imaging.Watermark{
+		Image:    img,
+		Position: app.WatermarkPosition,
+		Opacity:  app.WatermarkOpacity,
+		Scale:    app.WatermarkScale,
+	}
+
+	err = wm.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("Watermarking meme images")
+	return wm, nil
+}
@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/sdblg/meme/pkg/utils"
+)
+
+// statusError is an error returned by a helper shared between handlers, together with the
+// HTTP status the handler should report it with.
+type statusError struct {
+	status int
+	err    error
+}
+
+func (e *statusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.err
+}
+
+// writeError reports err as a JSON error response, using the status of a statusError or
+// 500 Internal Server Error for anything else.
+func writeError(w http.ResponseWriter, err error) {
+	var se *statusError
+	if errors.As(err, &se) {
+		_ = utils.ErrorJSON(w, se.err, se.status)
+		return
+	}
+
+	_ = utils.ErrorJSON(w, err, http.StatusInternalServerError)
+}
@@ -15,6 +15,20 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 )
 
+const (
+	// maxNearbyRadius is half the earth's circumference, in metres; anything larger
+	// already covers the whole globe.
+	maxNearbyRadius    = 20_037_508
+	defaultNearbyLimit = 100
+	maxNearbyLimit     = 1000
+
+	defaultSimilarDistance = 10
+	maxSimilarLimit        = 50
+
+	// maxZoom is the deepest web map zoom level the map endpoints accept.
+	maxZoom = 22
+)
+
 // Home displays the status of the api, as JSON.
 func (app *Application) Home(w http.ResponseWriter, r *http.Request) {
 	var payload = struct {
@@ -30,14 +44,190 @@ func (app *Application) Home(w http.ResponseWriter, r *http.Request) {
 	_ = utils.WriteJSON(w, http.StatusOK, payload)
 }
 
-// AllMemes returns a slice of all memes as JSON.
+// AllMemes returns a slice of all memes as JSON, or as a GeoJSON FeatureCollection. If a
+// bbox query parameter (minLon,minLat,maxLon,maxLat) is supplied, only memes inside that
+// viewport are returned.
 func (app *Application) AllMemes(w http.ResponseWriter, r *http.Request) {
-	memes, err := app.DB.AllMemes()
+	var memes []*models.Meme
+	var err error
+
+	if bbox := r.URL.Query().Get("bbox"); bbox != "" {
+		var box models.BBox
+		box, err = models.ParseBBox(bbox)
+		if err != nil {
+			_ = utils.ErrorJSON(w, err)
+			return
+		}
+		memes, err = app.DB.MemesInBBox(box, 0)
+	} else {
+		memes, err = app.DB.AllMemes()
+	}
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	writeMemes(w, r, memes)
+}
+
+// NearbyMemes returns the memes within radius_m metres of the lat/lon query parameters,
+// closest first, as JSON. Each meme carries its distance from the point in distance_m.
+func (app *Application) NearbyMemes(w http.ResponseWriter, r *http.Request) {
+	lat, err := strconv.ParseFloat(r.URL.Query().Get("lat"), 64)
+	if err != nil {
+		_ = utils.ErrorJSON(w, models.ErrInvalidLatitude)
+		return
+	}
+
+	lon, err := strconv.ParseFloat(r.URL.Query().Get("lon"), 64)
+	if err != nil {
+		_ = utils.ErrorJSON(w, models.ErrInvalidLongitude)
+		return
+	}
+
+	err = models.ValidateCoordinates(lat, lon)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	radius, err := strconv.ParseFloat(r.URL.Query().Get("radius_m"), 64)
+	if err != nil || radius <= 0 || radius > maxNearbyRadius {
+		_ = utils.ErrorJSON(
+			w,
+			fmt.Errorf("radius_m must be a number between 0 and %d", maxNearbyRadius),
+		)
+		return
+	}
+
+	limit := defaultNearbyLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxNearbyLimit {
+			_ = utils.ErrorJSON(
+				w,
+				fmt.Errorf("limit must be a number between 1 and %d", maxNearbyLimit),
+			)
+			return
+		}
+	}
+
+	memes, err := app.DB.NearbyMemes(lat, lon, radius, limit)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	writeMemes(w, r, memes)
+}
+
+// MemeClusters groups the memes inside the bbox viewport into clusters sized for the map
+// zoom level, and returns them as JSON.
+func (app *Application) MemeClusters(w http.ResponseWriter, r *http.Request) {
+	box, err := models.ParseBBox(r.URL.Query().Get("bbox"))
 	if err != nil {
 		_ = utils.ErrorJSON(w, err)
 		return
 	}
 
+	zoom, err := strconv.Atoi(r.URL.Query().Get("zoom"))
+	if err != nil || zoom < 0 || zoom > maxZoom {
+		_ = utils.ErrorJSON(w, fmt.Errorf("zoom must be a number between 0 and %d", maxZoom))
+		return
+	}
+
+	clusters, err := app.DB.MemeClusters(box, zoom)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	_ = utils.WriteJSON(w, http.StatusOK, clusters)
+}
+
+// SimilarMemes returns the memes whose images look like the given meme's, most similar
+// first, as JSON. Similarity is the Hamming distance between perceptual hashes, and only
+// memes within max_distance bits (default 10) are returned.
+func (app *Application) SimilarMemes(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	maxDistance := defaultSimilarDistance
+	if v := r.URL.Query().Get("max_distance"); v != "" {
+		maxDistance, err = strconv.Atoi(v)
+		if err != nil || maxDistance < 0 || maxDistance > 64 {
+			_ = utils.ErrorJSON(w, errors.New("max_distance must be a number between 0 and 64"))
+			return
+		}
+	}
+
+	meme, err := app.DB.OneMeme(id)
+	if err != nil || !app.canSeeMeme(w, r, meme) {
+		_ = utils.ErrorJSON(w, errors.New("meme not found"), http.StatusNotFound)
+		return
+	}
+
+	if meme.PHash == nil {
+		_ = utils.ErrorJSON(
+			w,
+			fmt.Errorf("meme %d has no perceptual hash", meme.ID),
+			http.StatusNotFound,
+		)
+		return
+	}
+
+	memes, err := app.DB.SimilarMemes(*meme.PHash, maxDistance, meme.ID, maxSimilarLimit, 0)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	writeMemes(w, r, memes)
+}
+
+// canSeeMeme reports whether the client may see meme: anyone may see public memes, while
+// private and pending ones are only shown to their owner, moderators and admins.
+func (app *Application) canSeeMeme(
+	w http.ResponseWriter,
+	r *http.Request,
+	meme *models.Meme,
+) bool {
+	if meme.IsPublic() {
+		return true
+	}
+
+	user, err := app.currentUser(w, r)
+	if err != nil {
+		return false
+	}
+
+	return meme.OwnedBy(user.ID) || user.CanModerate()
+}
+
+// wantsGeoJSON reports whether the client prefers GeoJSON over plain JSON. Responses that
+// depend on it must vary on Accept, so that caches keep the two apart.
+func wantsGeoJSON(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Add("Vary", "Accept")
+	return utils.Negotiate(r, utils.ContentTypeJSON, utils.ContentTypeGeoJSON) ==
+		utils.ContentTypeGeoJSON
+}
+
+// writeMemes writes memes as a JSON array, or as a GeoJSON FeatureCollection when the
+// client asks for application/geo+json.
+func writeMemes[T models.Locatable](w http.ResponseWriter, r *http.Request, memes []T) {
+	if wantsGeoJSON(w, r) {
+		_ = utils.WriteJSON(
+			w,
+			http.StatusOK,
+			models.NewFeatureCollection(memes),
+			http.Header{"Content-Type": {utils.ContentTypeGeoJSON}},
+		)
+		return
+	}
+
 	_ = utils.WriteJSON(w, http.StatusOK, memes)
 }
 
@@ -69,11 +259,19 @@ func (app *Application) authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// registered users must have followed the link emailed to them first
+	if user.EmailVerifiedAt == nil {
+		_ = utils.ErrorJSON(w, errors.New("email address not verified"), http.StatusForbidden)
+		return
+	}
+
 	// create a jwt user
 	u := services.JwtUser{
-		ID:        user.ID,
-		FirstName: user.FirstName,
-		LastName:  user.LastName,
+		ID:           user.ID,
+		FirstName:    user.FirstName,
+		LastName:     user.LastName,
+		Role:         user.Role,
+		TokenVersion: user.TokenVersion,
 	}
 
 	// generate tokens
@@ -89,7 +287,9 @@ func (app *Application) authenticate(w http.ResponseWriter, r *http.Request) {
 	_ = utils.WriteJSON(w, http.StatusAccepted, tokens)
 }
 
-// refreshToken checks for a valid refresh cookie, and returns a JWT if it finds one.
+// refreshToken checks for a valid refresh cookie, and returns a JWT if it finds one. The
+// user is looked up again, so the new token carries their current role, and refresh
+// tokens from before their password was last reset are refused.
 func (app *Application) refreshToken(w http.ResponseWriter, r *http.Request) {
 	for _, cookie := range r.Cookies() {
 		if cookie.Name == app.Auth.CookieName {
@@ -122,10 +322,18 @@ func (app *Application) refreshToken(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 
+			// refresh tokens issued before a password reset are no longer valid
+			if claims.Version != user.TokenVersion {
+				_ = utils.ErrorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+				return
+			}
+
 			u := services.JwtUser{
-				ID:        user.ID,
-				FirstName: user.FirstName,
-				LastName:  user.LastName,
+				ID:           user.ID,
+				FirstName:    user.FirstName,
+				LastName:     user.LastName,
+				Role:         user.Role,
+				TokenVersion: user.TokenVersion,
 			}
 
 			tokenPairs, err := app.Auth.GenerateTokenPair(&u)
@@ -152,7 +360,8 @@ func (app *Application) logout(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusAccepted)
 }
 
-// GetMeme returns one meme, as JSON.
+// GetMeme returns one meme, as JSON or as a GeoJSON Feature. Memes that are not public
+// are only returned to their owner, moderators and admins, with signed image URLs.
 func (app *Application) GetMeme(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	memeID, err := strconv.Atoi(id)
@@ -162,19 +371,76 @@ func (app *Application) GetMeme(w http.ResponseWriter, r *http.Request) {
 	}
 
 	meme, err := app.DB.OneMeme(memeID)
-	if err != nil {
-		_ = utils.ErrorJSON(w, err)
+	if err != nil || !app.canSeeMeme(w, r, meme) {
+		_ = utils.ErrorJSON(w, errors.New("meme not found"), http.StatusNotFound)
+		return
+	}
+
+	meme = app.signMeme(meme)
+
+	if wantsGeoJSON(w, r) {
+		_ = utils.WriteJSON(
+			w,
+			http.StatusOK,
+			models.NewFeature(meme),
+			http.Header{"Content-Type": {utils.ContentTypeGeoJSON}},
+		)
 		return
 	}
 
 	_ = utils.WriteJSON(w, http.StatusOK, meme)
 }
 
-// InsertMeme receives a JSON payload and tries to insert a meme into the database.
+// memeInput is the JSON body of PUT /admin/memes. The image's size, hashes and duplicate
+// are only worked out for uploaded images, so the client cannot set them here.
+type memeInput struct {
+	Lat        float64  `json:"lat"`
+	Lon        float64  `json:"lon"`
+	Image      string   `json:"image"`
+	Title      string   `json:"title"`
+	Caption    string   `json:"caption"`
+	AltText    string   `json:"alt_text"`
+	Tags       []string `json:"tags"`
+	Visibility string   `json:"visibility"`
+	Watermark  *bool    `json:"watermark"`
+}
+
+// InsertMeme receives a JSON payload and tries to insert a meme into the database, owned
+// by the current user.
 func (app *Application) InsertMeme(w http.ResponseWriter, r *http.Request) {
-	var meme models.Meme
+	user, err := app.currentUser(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var payload memeInput
 
-	err := utils.ReadJSON(w, r, &meme)
+	err = utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	meme := models.Meme{
+		Lan:        payload.Lat,
+		Lon:        payload.Lon,
+		Image:      payload.Image,
+		Title:      payload.Title,
+		Caption:    payload.Caption,
+		AltText:    payload.AltText,
+		Visibility: payload.Visibility,
+		Watermark:  payload.Watermark,
+		OwnerID:    &user.ID,
+	}
+
+	meme.Tags, err = models.NormalizeTags(payload.Tags)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	err = meme.Validate()
 	if err != nil {
 		_ = utils.ErrorJSON(w, err)
 		return
@@ -197,32 +463,109 @@ func (app *Application) InsertMeme(w http.ResponseWriter, r *http.Request) {
 	_ = utils.WriteJSON(w, http.StatusAccepted, resp)
 }
 
-// UpdateMeme updates a meme in the database, based on a JSON payload.
-func (app *Application) UpdateMeme(w http.ResponseWriter, r *http.Request) {
-	var payload models.Meme
+// memeUpdate is the JSON body of PATCH /admin/memes/{id}. Fields that are not sent are
+// left alone; "tags": [] removes all the meme's tags.
+type memeUpdate struct {
+	ID         int      `json:"id"`
+	Lat        *float64 `json:"lat"`
+	Lon        *float64 `json:"lon"`
+	Title      *string  `json:"title"`
+	Caption    *string  `json:"caption"`
+	AltText    *string  `json:"alt_text"`
+	Tags       []string `json:"tags"`
+	Visibility *string  `json:"visibility"`
+	Watermark  *bool    `json:"watermark"`
+}
 
-	err := utils.ReadJSON(w, r, &payload)
+// UpdateMeme updates a meme in the database, by ID, based on a JSON payload. Only the
+// fields in the payload are changed. Turning the watermark on or off regenerates the
+// meme's variants. Only the meme's owner or an admin may update it, and only moderators
+// and admins may move it out of pending.
+func (app *Application) UpdateMeme(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
 		_ = utils.ErrorJSON(w, err)
 		return
 	}
 
-	meme, err := app.DB.OneMeme(payload.ID)
+	var payload memeUpdate
+
+	err = utils.ReadJSON(w, r, &payload)
 	if err != nil {
 		_ = utils.ErrorJSON(w, err)
 		return
 	}
 
-	meme.Lan = payload.Lan
-	meme.Lon = payload.Lon	
+	if payload.ID != 0 && payload.ID != id {
+		_ = utils.ErrorJSON(w, errors.New("id in the payload does not match the URL"))
+		return
+	}
+
+	user, err := app.currentUser(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	meme, err := app.changeableMeme(w, r, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if payload.Lat != nil {
+		meme.Lan = *payload.Lat
+	}
+	if payload.Lon != nil {
+		meme.Lon = *payload.Lon
+	}
+	if payload.Title != nil {
+		meme.Title = *payload.Title
+	}
+	if payload.Caption != nil {
+		meme.Caption = *payload.Caption
+	}
+	if payload.AltText != nil {
+		meme.AltText = *payload.AltText
+	}
+	meme.Tags, err = models.NormalizeTags(payload.Tags)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+	if payload.Visibility != nil {
+		if meme.Visibility == models.VisibilityPending &&
+			*payload.Visibility != models.VisibilityPending && !user.CanModerate() {
+			writeError(w, &statusError{
+				http.StatusForbidden,
+				errors.New("only moderators and admins may approve pending memes"),
+			})
+			return
+		}
+		meme.Visibility = *payload.Visibility
+	}
+	rewatermark := payload.Watermark != nil && *payload.Watermark != meme.Watermarked()
+	if payload.Watermark != nil {
+		meme.Watermark = payload.Watermark
+	}
 	meme.UpdatedAt = time.Now()
 
+	err = meme.Validate()
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
 	err = app.DB.UpdateMeme(*meme)
 	if err != nil {
 		_ = utils.ErrorJSON(w, err)
 		return
 	}
 
+	if rewatermark {
+		app.Variants.Enqueue(meme.ID)
+	}
+
 	resp := utils.JSONResponse{
 		Error:   false,
 		Message: "meme updated",
@@ -231,7 +574,8 @@ func (app *Application) UpdateMeme(w http.ResponseWriter, r *http.Request) {
 	_ = utils.WriteJSON(w, http.StatusAccepted, resp)
 }
 
-// DeleteMeme deletes a meme from the database, by ID.
+// DeleteMeme deletes a meme from the database, by ID. Only the meme's owner or an admin
+// may delete it.
 func (app *Application) DeleteMeme(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
@@ -239,6 +583,12 @@ func (app *Application) DeleteMeme(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	_, err = app.changeableMeme(w, r, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
 	err = app.DB.DeleteMeme(id)
 	if err != nil {
 		_ = utils.ErrorJSON(w, err)
@@ -253,15 +603,26 @@ func (app *Application) DeleteMeme(w http.ResponseWriter, r *http.Request) {
 	_ = utils.WriteJSON(w, http.StatusAccepted, resp)
 }
 
+// EnableCORS allows the front end to call the API with credentials. CORS preflight requests
+// are answered here; other OPTIONS requests, such as tus discovery, reach the router.
 func EnableCORS(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "https://learn-code.ca")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Set(
+			"Access-Control-Expose-Headers",
+			"Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, "+
+				"Upload-Offset, Upload-Length, Upload-Expires, Meme-ID",
+		)
 
-		if r.Method == "OPTIONS" {
-			w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
 			w.Header().
-				Set("Access-Control-Allow-Headers", "Accept, Content-Type, X-CSRF-Token, Authorization")
+				Set("Access-Control-Allow-Methods", "GET,HEAD,POST,PUT,PATCH,DELETE,OPTIONS")
+			w.Header().Set(
+				"Access-Control-Allow-Headers",
+				"Accept, Content-Type, X-CSRF-Token, Authorization, "+
+					"Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset",
+			)
 			return
 		} else {
 			h.ServeHTTP(w, r)
@@ -0,0 +1,194 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sdblg/meme/pkg/models"
+	"github.com/sdblg/meme/pkg/repository"
+	"github.com/sdblg/meme/pkg/services"
+	"github.com/sdblg/meme/pkg/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// immutableMaxAge is the Cache-Control max-age, in seconds, of content-addressed images:
+// one year, the longest HTTP caches are expected to honour.
+const immutableMaxAge = 365 * 24 * 60 * 60
+
+// contentAddressed matches the keys of memes, templates and their variants, which are
+// named after the SHA-256 of the uploaded image, and of the watermark if any, so the bytes
+// behind them never change. The first submatch is the image's digest.
+var contentAddressed = regexp.MustCompile(
+	`^(?:variants/|templates/)?([0-9a-f]{64})(?:_[0-9]+(?:_w[0-9a-f]{8})?)?\.[a-z]+$`,
+)
+
+// watermarkedKey matches the keys of watermarked copies of meme images, which end in the
+// copy's width and the watermark's fingerprint.
+var watermarkedKey = regexp.MustCompile(`^variants/.*_[0-9]+_w[0-9a-f]{8}\.[a-z]+$`)
+
+// privateKeyPrefixes are storage key prefixes that GetImage never serves. Originals keep
+// their EXIF metadata and are only sent by GetOriginalImage, and uploads/ holds the parts of
+// unfinished resumable uploads.
+var privateKeyPrefixes = []string{"originals/", "uploads/"}
+
+// GetImage serves an image from blob storage by its key, as found in meme and template
+// image paths under /images/.
+//
+// Images of memes that are not public need a URL signed by app.ImageURLs, as handed out
+// with those memes, and are only cached privately until the signature expires.
+//
+// Responses carry a strong ETag, so clients can revalidate with If-None-Match, and
+// support Range requests. Content-addressed keys are cached for a year as immutable;
+// anything else must be revalidated on every use.
+func (app *Application) GetImage(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "*")
+
+	if !publicImageKey(key) {
+		_ = utils.ErrorJSON(w, errors.New("image not found"), http.StatusNotFound)
+		return
+	}
+
+	scope, maxAge := "public", immutableMaxAge
+
+	expires, err := app.ImageURLs.Verify(models.ImagePath(key), r.URL.Query())
+	switch {
+	case err == nil:
+		scope, maxAge = "private", int(time.Until(expires)/time.Second)
+	case errors.Is(err, services.ErrURLUnsigned):
+		public, err := app.imageIsPublic(key)
+		if err != nil {
+			_ = utils.ErrorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+		if !public {
+			_ = utils.ErrorJSON(w, errors.New("image not found"), http.StatusNotFound)
+			return
+		}
+	default:
+		_ = utils.ErrorJSON(w, err, http.StatusForbidden)
+		return
+	}
+
+	blob, err := app.Storage.Get(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, repository.ErrBlobNotFound) {
+			_ = utils.ErrorJSON(w, errors.New("image not found"), http.StatusNotFound)
+			return
+		}
+		_ = utils.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	if contentAddressed.MatchString(key) {
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256([]byte(key))))
+		w.Header().Set("Cache-Control", fmt.Sprintf("%s, max-age=%d, immutable", scope, maxAge))
+	} else {
+		etag, err := contentETag(blob)
+		if err != nil {
+			_ = utils.ErrorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", scope+", no-cache")
+	}
+
+	w.Header().Set("Content-Type", blob.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	// ServeContent answers If-None-Match with 304 Not Modified using the ETag above, and
+	// handles Range and If-Range.
+	http.ServeContent(w, r, "", blob.ModTime, blob)
+}
+
+// imageIsPublic reports whether the image stored under key may be served without a
+// signed URL. Keys that are not content-addressed are those of memes stored before
+// images were named after their content, and follow the meme that uses them. While a
+// watermark is configured, the images and variants of watermarked memes are only public
+// in their watermarked copies, so that copies made before the watermark, or while it was
+// turned off, cannot be used to get around it.
+func (app *Application) imageIsPublic(key string) (bool, error) {
+	unmarked := app.Variants != nil && app.Variants.Watermark != nil &&
+		!watermarkedKey.MatchString(key)
+
+	m := contentAddressed.FindStringSubmatch(key)
+	if m == nil {
+		return app.DB.LegacyImageIsPublic(key, unmarked)
+	}
+
+	template := strings.HasPrefix(key, templateKeyPrefix)
+	unmarked = unmarked && !template
+
+	return app.DB.ImageIsPublic(m[1], template, unmarked)
+}
+
+// signMeme returns meme as it should be sent to a client: unchanged if it is public, or
+// else a copy with its image and variant paths signed, so that the client can load them
+// for a while without the images being public.
+func (app *Application) signMeme(meme *models.Meme) *models.Meme {
+	if meme.IsPublic() {
+		return meme
+	}
+
+	signed := *meme
+	signed.Image = app.signImagePath(meme.Image)
+
+	if meme.Variants != nil {
+		signed.Variants = make(map[string]string, len(meme.Variants))
+		for width, p := range meme.Variants {
+			signed.Variants[width] = app.signImagePath(p)
+		}
+	}
+
+	return &signed
+}
+
+// signImagePath signs an image path served by GetImage. Other paths are left alone.
+func (app *Application) signImagePath(p string) string {
+	if !strings.HasPrefix(p, models.ImagePathPrefix) {
+		return p
+	}
+	return app.ImageURLs.Sign(p)
+}
+
+// publicImageKey reports whether key is a well-formed storage key that may be served to
+// anyone.
+func publicImageKey(key string) bool {
+	if key == "" || path.Clean("/"+key) != "/"+key {
+		return false
+	}
+
+	for _, prefix := range privateKeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// contentETag returns a strong ETag for a blob from the SHA-256 of its contents, leaving
+// it positioned at the start.
+func contentETag(blob *repository.Blob) (string, error) {
+	h := sha256.New()
+
+	_, err := io.Copy(h, blob)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = blob.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf(`"%x"`, h.Sum(nil)), nil
+}
@@ -3,6 +3,8 @@ package controllers
 import (
 	"net/http"
 
+	"github.com/sdblg/meme/pkg/models"
+
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
@@ -16,20 +18,64 @@ func (app *Application) Routes() http.Handler {
 
 	mux.Get("/", app.Home)
 
+	mux.Post("/register", app.Register)
+	mux.Get("/verify-email", app.VerifyEmail)
+	mux.Post("/password/forgot", app.ForgotPassword)
+	mux.Post("/password/reset", app.ResetPassword)
 	mux.Post("/authenticate", app.authenticate)
 	mux.Get("/refresh", app.refreshToken)
 	mux.Get("/logout", app.logout)
 
 	mux.Get("/memes", app.AllMemes)
+	mux.Get("/memes/nearby", app.NearbyMemes)
+	mux.Get("/memes/clusters", app.MemeClusters)
+	mux.Get("/memes/search", app.SearchMemes)
 	mux.Get("/memes/{id}", app.GetMeme)
+	mux.Get("/memes/{id}/similar", app.SimilarMemes)
+
+	mux.With(app.Auth.AuthRequired).Post("/memes/generate", app.GenerateMeme)
+
+	mux.Get("/tags", app.AllTags)
+	mux.Get("/tags/{tag}/memes", app.MemesWithTag)
+
+	mux.Get("/users/{id}/memes", app.UserMemes)
+
+	mux.Get("/templates", app.AllTemplates)
+	mux.Get("/templates/{id}", app.GetTemplate)
+
+	mux.Get("/tiles/{z}/{x}/{y}.mvt", app.Tile)
+
+	mux.Get("/images/*", app.GetImage)
+	mux.Head("/images/*", app.GetImage)
 
 	mux.Route("/admin", func(mux chi.Router) {
 		mux.Use(app.Auth.AuthRequired)
 
 		mux.Get("/memes/{id}", app.GetMeme)
+		mux.Get("/memes/{id}/original", app.GetOriginalImage)
 		mux.Put("/memes", app.InsertMeme)
+		mux.Post("/memes/upload", app.UploadMeme)
 		mux.Patch("/memes/{id}", app.UpdateMeme)
 		mux.Delete("/memes/{id}", app.DeleteMeme)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.Auth.RequireRole(models.RoleAdmin))
+
+			mux.Post("/templates", app.InsertTemplate)
+			mux.Delete("/templates/{id}", app.DeleteTemplate)
+
+			mux.Put("/users/{id}/role", app.UpdateUserRole)
+		})
+
+		mux.Route("/uploads", func(mux chi.Router) {
+			mux.Use(tusResumable)
+
+			mux.Options("/", app.UploadOptions)
+			mux.Post("/", app.CreateUpload)
+			mux.Head("/{id}", app.UploadStatus)
+			mux.Patch("/{id}", app.ResumeUpload)
+			mux.Delete("/{id}", app.DeleteUpload)
+		})
 	})
 
 	return mux
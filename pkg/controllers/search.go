@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/sdblg/meme/pkg/models"
+	"github.com/sdblg/meme/pkg/utils"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// SearchMemes returns the public memes whose title, tags, caption or alt text contain
+// every word of the q query parameter, or words starting with them, best match first, as
+// JSON or GeoJSON. Given lat, lon and radius_m, only memes within radius_m metres of the
+// point are searched, and each carries its distance in distance_m. Each meme has the
+// matching words of its text highlighted in highlight.
+func (app *Application) SearchMemes(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	terms, err := models.ParseSearchTerms(params.Get("q"))
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	query := models.SearchQuery{
+		Terms: terms,
+		Limit: defaultSearchLimit,
+	}
+
+	if params.Has("lat") || params.Has("lon") || params.Has("radius_m") {
+		query.Lat, err = strconv.ParseFloat(params.Get("lat"), 64)
+		if err != nil {
+			_ = utils.ErrorJSON(w, models.ErrInvalidLatitude)
+			return
+		}
+
+		query.Lon, err = strconv.ParseFloat(params.Get("lon"), 64)
+		if err != nil {
+			_ = utils.ErrorJSON(w, models.ErrInvalidLongitude)
+			return
+		}
+
+		err = models.ValidateCoordinates(query.Lat, query.Lon)
+		if err != nil {
+			_ = utils.ErrorJSON(w, err)
+			return
+		}
+
+		query.Radius, err = strconv.ParseFloat(params.Get("radius_m"), 64)
+		if err != nil || !(query.Radius > 0) || query.Radius > maxNearbyRadius {
+			_ = utils.ErrorJSON(
+				w,
+				fmt.Errorf("radius_m must be a number between 0 and %d", maxNearbyRadius),
+			)
+			return
+		}
+	}
+
+	if v := params.Get("limit"); v != "" {
+		query.Limit, err = strconv.Atoi(v)
+		if err != nil || query.Limit < 1 || query.Limit > maxSearchLimit {
+			_ = utils.ErrorJSON(
+				w,
+				fmt.Errorf("limit must be a number between 1 and %d", maxSearchLimit),
+			)
+			return
+		}
+	}
+
+	results, err := app.DB.SearchMemes(query)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	writeMemes(w, r, results)
+}
@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/sdblg/meme/pkg/models"
+	"github.com/sdblg/meme/pkg/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// AllTags returns the tags of public memes with their meme counts, most used first, in
+// JSON format.
+func (app *Application) AllTags(w http.ResponseWriter, r *http.Request) {
+	tags, err := app.DB.AllTags()
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	_ = utils.WriteJSON(w, http.StatusOK, tags)
+}
+
+// MemesWithTag returns the public memes with a tag, newest first, as JSON or GeoJSON. The
+// tag is normalised first, so /tags/Cats/memes finds memes tagged cats.
+func (app *Application) MemesWithTag(w http.ResponseWriter, r *http.Request) {
+	tag, err := models.NormalizeTag(chi.URLParam(r, "tag"))
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	memes, err := app.DB.MemesWithTag(tag)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	writeMemes(w, r, memes)
+}
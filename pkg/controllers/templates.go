@@ -0,0 +1,386 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sdblg/meme/pkg/imaging"
+	"github.com/sdblg/meme/pkg/models"
+	"github.com/sdblg/meme/pkg/repository"
+	"github.com/sdblg/meme/pkg/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// templateKeyPrefix is the storage key prefix template base images are stored under, so
+// they are kept apart from meme images.
+const templateKeyPrefix = "templates/"
+
+// generateRequest is the JSON body of POST /memes/generate. Captions maps text box names
+// to the text drawn into them; boxes without a caption are left empty.
+type generateRequest struct {
+	TemplateID int               `json:"template_id"`
+	Captions   map[string]string `json:"captions"`
+	Lat        float64           `json:"lat"`
+	Lon        float64           `json:"lon"`
+	Visibility string            `json:"visibility"`
+	Title      string            `json:"title"`
+	AltText    string            `json:"alt_text"`
+	Tags       []string          `json:"tags"`
+}
+
+// AllTemplates returns every meme template, in JSON format.
+func (app *Application) AllTemplates(w http.ResponseWriter, r *http.Request) {
+	templates, err := app.DB.AllTemplates()
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	_ = utils.WriteJSON(w, http.StatusOK, templates)
+}
+
+// GetTemplate returns one meme template, by ID.
+func (app *Application) GetTemplate(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	template, err := app.DB.OneTemplate(id)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	_ = utils.WriteJSON(w, http.StatusOK, template)
+}
+
+// InsertTemplate receives a multipart form with a base image, a name and a boxes field
+// holding the template's text boxes as a JSON array, and inserts a new meme template. The
+// image is stored with its metadata stripped, like uploaded memes.
+func (app *Application) InsertTemplate(w http.ResponseWriter, r *http.Request) {
+	err := app.parseUploadForm(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer func() {
+		_ = r.MultipartForm.RemoveAll()
+	}()
+
+	data, contentType, ext, err := formImage(r, "image")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	template := models.MemeTemplate{Name: strings.TrimSpace(r.FormValue("name"))}
+
+	err = json.Unmarshal([]byte(r.FormValue("boxes")), &template.Boxes)
+	if err != nil {
+		_ = utils.ErrorJSON(w, fmt.Errorf("boxes must be a JSON array of text boxes: %w", err))
+		return
+	}
+	for i := range template.Boxes {
+		template.Boxes[i].SetDefaults()
+	}
+
+	// Stripping the metadata of a rotated JPEG decodes it, so its size is checked first.
+	_, err = probeImage(data)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	public, err := imaging.StripMetadata(data)
+	if err != nil {
+		_ = utils.ErrorJSON(w, fmt.Errorf("stripping image metadata: %w", err))
+		return
+	}
+
+	info, err := probeImage(public)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	template.Width, template.Height = info.Width, info.Height
+
+	err = template.Validate()
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	key := fmt.Sprintf("%s%x%s", templateKeyPrefix, sha256.Sum256(data), ext)
+
+	err = app.Storage.Put(
+		r.Context(),
+		key,
+		bytes.NewReader(public),
+		int64(len(public)),
+		contentType,
+	)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	template.Image = models.ImagePath(key)
+	template.CreatedAt = time.Now()
+	template.UpdatedAt = time.Now()
+
+	template.ID, err = app.DB.InsertTemplate(template)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: fmt.Sprintf("template inserted with id: %d", template.ID),
+		Data:    template,
+	}
+
+	_ = utils.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// DeleteTemplate deletes a meme template, by ID. Its image is kept in storage, since memes
+// generated from it do not depend on it.
+func (app *Application) DeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	err = app.DB.DeleteTemplate(id)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: "template deleted",
+	}
+
+	_ = utils.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// GenerateMeme renders captions onto a template's text boxes and stores the result as a
+// new meme at the given coordinates, going through the same duplicate checks and variant
+// generation as an upload. The meme's caption is the text of the captions, one per line,
+// and it is owned by the current user.
+func (app *Application) GenerateMeme(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var req generateRequest
+
+	err = utils.ReadJSON(w, r, &req)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	meme := models.Meme{
+		Lan:        req.Lat,
+		Lon:        req.Lon,
+		Visibility: req.Visibility,
+		Title:      req.Title,
+		AltText:    req.AltText,
+		OwnerID:    &user.ID,
+	}
+
+	meme.Tags, err = models.NormalizeTags(req.Tags)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	err = meme.Validate()
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	template, err := app.DB.OneTemplate(req.TemplateID)
+	if err != nil {
+		_ = utils.ErrorJSON(
+			w,
+			fmt.Errorf("template %d not found", req.TemplateID),
+			http.StatusNotFound,
+		)
+		return
+	}
+
+	captions, err := templateCaptions(template, req.Captions)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	meme.Caption = captionText(captions)
+
+	err = meme.Validate()
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	data, contentType, ext, err := app.renderTemplate(r, template, captions)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = app.createMeme(r.Context(), data, contentType, ext, &meme)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: fmt.Sprintf("meme inserted with id: %d", meme.ID),
+		Data:    app.signMeme(&meme),
+	}
+
+	_ = utils.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// captionText returns the text of captions in reading order, top to bottom and left to
+// right, one caption per line.
+func captionText(captions []imaging.Caption) string {
+	sorted := append([]imaging.Caption(nil), captions...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i].Box.Min, sorted[j].Box.Min
+		return a.Y < b.Y || a.Y == b.Y && a.X < b.X
+	})
+
+	lines := make([]string, 0, len(sorted))
+	for _, c := range sorted {
+		lines = append(lines, c.Text)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// renderTemplate loads a template's base image and draws captions onto it, returning the
+// encoded result with its content type and extension. Animated templates keep their
+// frames and delays, and come out as animated GIFs.
+func (app *Application) renderTemplate(
+	r *http.Request,
+	template *models.MemeTemplate,
+	captions []imaging.Caption,
+) ([]byte, string, string, error) {
+	blob, err := app.Storage.Get(r.Context(), models.ImageKeyFromPath(template.Image))
+	if err != nil {
+		if errors.Is(err, repository.ErrBlobNotFound) {
+			return nil, "", "", &statusError{
+				http.StatusNotFound,
+				errors.New("template image not found"),
+			}
+		}
+		return nil, "", "", err
+	}
+	defer blob.Close()
+
+	data, err := io.ReadAll(blob)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	info, err := imaging.Probe(data)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("reading template image: %w", err)
+	}
+
+	// The captions are rendered once and drawn onto every frame of animated templates.
+	overlay, err := imaging.RenderCaptions(image.Rect(0, 0, info.Width, info.Height), captions)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	if info.Animated() {
+		return imaging.RenderAnimation(data, func(frame image.Image) image.Image {
+			return imaging.DrawOverlay(frame, overlay)
+		})
+	}
+
+	img, format, err := imaging.Decode(data)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("decoding template image: %w", err)
+	}
+
+	return imaging.Encode(imaging.DrawOverlay(img, overlay), format)
+}
+
+// templateCaptions maps caption text onto the template's text boxes. Captions naming a box
+// the template does not have are rejected, so typos do not silently drop text.
+func templateCaptions(
+	template *models.MemeTemplate,
+	text map[string]string,
+) ([]imaging.Caption, error) {
+	boxes := make(map[string]models.TextBox, len(template.Boxes))
+	for _, b := range template.Boxes {
+		boxes[b.Name] = b
+	}
+
+	var captions []imaging.Caption
+
+	for name, t := range text {
+		b, ok := boxes[name]
+		if !ok {
+			return nil, fmt.Errorf("template %d has no text box named %q", template.ID, name)
+		}
+
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if b.Uppercase {
+			t = strings.ToUpper(t)
+		}
+
+		fill, err := imaging.ParseHexColor(b.Color)
+		if err != nil {
+			return nil, err
+		}
+		stroke, err := imaging.ParseHexColor(b.StrokeColor)
+		if err != nil {
+			return nil, err
+		}
+
+		captions = append(captions, imaging.Caption{
+			Text:        t,
+			Box:         image.Rect(b.X, b.Y, b.X+b.Width, b.Y+b.Height),
+			FontSize:    b.FontSize,
+			Align:       b.Align,
+			Color:       fill,
+			StrokeColor: stroke,
+			StrokeWidth: b.StrokeWidth,
+		})
+	}
+
+	if len(captions) == 0 {
+		return nil, errors.New("at least one caption is required")
+	}
+
+	return captions, nil
+}
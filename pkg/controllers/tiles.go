@@ -0,0 +1,123 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sdblg/meme/pkg/models"
+	"github.com/sdblg/meme/pkg/utils"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/mvt"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/maptile"
+)
+
+const (
+	contentTypeMVT = "application/vnd.mapbox-vector-tile"
+
+	// tileBuffer is how far, in tile extent units, points outside a tile are still
+	// included so that markers straddling a tile edge are drawn on both tiles.
+	tileBuffer = 64
+
+	// tileMemeLimit is the most memes a tile carries, so that low zoom tiles covering
+	// much of the world stay small and cheap to build. The newest memes are kept.
+	tileMemeLimit = 1000
+)
+
+// Tile returns the memes inside web map tile z/x/y as a Mapbox Vector Tile with a single
+// "memes" point layer, carrying each meme's id and image, for up to tileMemeLimit of the
+// newest memes. Tiles are sent with a strong ETag and a Cache-Control max-age of
+// app.TileMaxAge, so that clients and proxies can cache them and revalidate with
+// If-None-Match.
+func (app *Application) Tile(w http.ResponseWriter, r *http.Request) {
+	tile, err := tileFromRequest(r)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	memes, err := app.DB.MemesInBBox(tileQueryBox(tile), tileMemeLimit)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	fc := geojson.NewFeatureCollection()
+	for _, meme := range memes {
+		f := geojson.NewFeature(orb.Point{meme.Lon, meme.Lan})
+		f.ID = meme.ID
+		f.Properties["id"] = meme.ID
+		f.Properties["image"] = meme.Image
+		fc.Append(f)
+	}
+
+	layers := mvt.NewLayers(map[string]*geojson.FeatureCollection{"memes": fc})
+	layers.ProjectToTile(tile)
+	layers.Clip(orb.Bound{
+		Min: orb.Point{-tileBuffer, -tileBuffer},
+		Max: orb.Point{mvt.DefaultExtent + tileBuffer, mvt.DefaultExtent + tileBuffer},
+	})
+	// Clipping leaves points outside the buffer with a nil geometry, which Marshal
+	// cannot encode.
+	layers.RemoveEmpty(0, 0)
+
+	data, err := mvt.Marshal(layers)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentTypeMVT)
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256(data)))
+	w.Header().
+		Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(app.TileMaxAge/time.Second)))
+
+	// ServeContent answers If-None-Match with 304 Not Modified using the ETag above.
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+// tileFromRequest reads and validates the z, x and y tile coordinates from the URL.
+func tileFromRequest(r *http.Request) (maptile.Tile, error) {
+	z, err := strconv.Atoi(chi.URLParam(r, "z"))
+	if err != nil || z < 0 || z > maxZoom {
+		return maptile.Tile{}, fmt.Errorf("z must be a number between 0 and %d", maxZoom)
+	}
+
+	size := 1 << z
+
+	x, err := strconv.Atoi(chi.URLParam(r, "x"))
+	if err != nil || x < 0 || x >= size {
+		return maptile.Tile{}, errors.New("x is outside the tile grid for this zoom")
+	}
+
+	y, err := strconv.Atoi(chi.URLParam(r, "y"))
+	if err != nil || y < 0 || y >= size {
+		return maptile.Tile{}, errors.New("y is outside the tile grid for this zoom")
+	}
+
+	return maptile.New(uint32(x), uint32(y), maptile.Zoom(z)), nil
+}
+
+// tileQueryBox returns the bounding box to query for a tile, grown by tileBuffer on each
+// side and clamped to the valid coordinate range.
+func tileQueryBox(tile maptile.Tile) models.BBox {
+	bound := tile.Bound()
+
+	padLon := (bound.Max.Lon() - bound.Min.Lon()) * tileBuffer / mvt.DefaultExtent
+	padLat := (bound.Max.Lat() - bound.Min.Lat()) * tileBuffer / mvt.DefaultExtent
+
+	return models.BBox{
+		MinLon: math.Max(bound.Min.Lon()-padLon, -180),
+		MinLat: math.Max(bound.Min.Lat()-padLat, -90),
+		MaxLon: math.Min(bound.Max.Lon()+padLon, 180),
+		MaxLat: math.Min(bound.Max.Lat()+padLat, 90),
+	}
+}
@@ -0,0 +1,432 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sdblg/meme/pkg/imaging"
+	"github.com/sdblg/meme/pkg/models"
+	"github.com/sdblg/meme/pkg/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// tusVersion is the version of the tus resumable upload protocol (https://tus.io) that
+// the /admin/uploads endpoints speak.
+const tusVersion = "1.0.0"
+
+// tusExtensions are the tus protocol extensions supported on top of the core protocol.
+const tusExtensions = "creation,expiration,termination"
+
+// tusContentType is the content type of PATCH requests carrying upload bytes.
+const tusContentType = "application/offset+octet-stream"
+
+// tusResumable checks that requests speak the supported tus protocol version, and marks
+// responses as speaking it. OPTIONS requests, which discover the version, need not.
+func tusResumable(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			_ = utils.ErrorJSON(
+				w,
+				fmt.Errorf("tus protocol version %s is required", tusVersion),
+				http.StatusPreconditionFailed,
+			)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// UploadOptions describes the server's tus support.
+func (app *Application) UploadOptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(app.MaxUploadBytes, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CreateUpload starts a resumable upload of Upload-Length bytes, up to
+// app.MaxUploadBytes, and returns its URL in the Location header. Upload-Metadata may
+// carry the same fields about the meme it turns into as UploadMeme's form, such as lat,
+// lon and title; without lat and lon, the image's EXIF GPS position is used. The upload,
+// and the meme it turns into, belong to the current user.
+func (app *Application) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		_ = utils.ErrorJSON(w, errors.New("Upload-Length must be a number of bytes"))
+		return
+	}
+	if length > app.MaxUploadBytes {
+		_ = utils.ErrorJSON(
+			w,
+			fmt.Errorf("upload must not be larger than %d bytes", app.MaxUploadBytes),
+			http.StatusRequestEntityTooLarge,
+		)
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	// Check the meme's fields now rather than after the whole image has been sent.
+	meme, err := uploadedMeme(metadataField(metadata))
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+	if metadata["lat"] != "" || metadata["lon"] != "" {
+		err = uploadCoordinates(metadata["lat"], metadata["lon"], imaging.Metadata{}, &meme)
+	} else {
+		err = meme.Validate()
+	}
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	upload := models.Upload{
+		ID:        id,
+		Length:    length,
+		Metadata:  metadata,
+		OwnerID:   user.ID,
+		ExpiresAt: time.Now().Add(app.UploadExpiry),
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	err = app.DB.InsertUpload(upload)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/admin/uploads/"+id)
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// UploadStatus reports how much of an upload has been received, so that the client can
+// resume it from there. Finished uploads also carry the ID of the meme they became.
+func (app *Application) UploadStatus(w http.ResponseWriter, r *http.Request) {
+	upload, err := app.liveUpload(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	writeUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusOK)
+}
+
+// ResumeUpload appends the request body to an upload at Upload-Offset, which must be
+// where the upload has got to. Bytes received before the connection drops are kept, so
+// the client can carry on from the offset UploadStatus then reports. The request that
+// completes the upload turns it into a meme, like UploadMeme, and the response carries
+// the meme's ID in a Meme-ID header.
+func (app *Application) ResumeUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != tusContentType {
+		_ = utils.ErrorJSON(
+			w,
+			fmt.Errorf("Content-Type must be %s", tusContentType),
+			http.StatusUnsupportedMediaType,
+		)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		_ = utils.ErrorJSON(w, errors.New("Upload-Offset must be a number of bytes"))
+		return
+	}
+
+	upload, err := app.liveUpload(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if offset != upload.Offset {
+		_ = utils.ErrorJSON(
+			w,
+			fmt.Errorf("upload is at offset %d, not %d", upload.Offset, offset),
+			http.StatusConflict,
+		)
+		return
+	}
+
+	// The request context ends when the client goes away, but whatever it sent until then
+	// should still be kept.
+	ctx := context.Background()
+
+	remaining := upload.Length - upload.Offset
+	data, readErr := io.ReadAll(io.LimitReader(r.Body, remaining+1))
+	if int64(len(data)) > remaining {
+		_ = utils.ErrorJSON(
+			w,
+			fmt.Errorf("upload is longer than its Upload-Length of %d bytes", upload.Length),
+			http.StatusRequestEntityTooLarge,
+		)
+		return
+	}
+
+	if len(data) > 0 {
+		err = app.appendUploadPart(ctx, upload, data)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	if readErr != nil {
+		_ = utils.ErrorJSON(w, readErr)
+		return
+	}
+
+	if upload.Complete() && upload.MemeID == nil {
+		err = app.finishUpload(ctx, upload)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	writeUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DeleteUpload abandons an upload, deleting whatever has been received of it. The meme of
+// a finished upload is kept.
+func (app *Application) DeleteUpload(w http.ResponseWriter, r *http.Request) {
+	upload, err := app.liveUpload(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = app.Uploads.Delete(r.Context(), upload)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// liveUpload returns the upload named by the request's id URL parameter, or a 404 error
+// if there is none or it belongs to another user, and a 410 error if it has expired but
+// not been deleted yet. Admins may reach any upload.
+func (app *Application) liveUpload(w http.ResponseWriter, r *http.Request) (*models.Upload, error) {
+	user, err := app.currentUser(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	notFound := &statusError{http.StatusNotFound, errors.New("upload not found")}
+
+	upload, err := app.DB.OneUpload(chi.URLParam(r, "id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, notFound
+		}
+		return nil, err
+	}
+
+	if upload.OwnerID != user.ID && !user.IsAdmin() {
+		return nil, notFound
+	}
+
+	if time.Now().After(upload.ExpiresAt) {
+		return nil, &statusError{http.StatusGone, errors.New("upload has expired")}
+	}
+
+	return upload, nil
+}
+
+// appendUploadPart stores data as the next part of upload and advances its offset and
+// expiry. If another request got there first, the part is discarded with a 409 error.
+func (app *Application) appendUploadPart(
+	ctx context.Context,
+	upload *models.Upload,
+	data []byte,
+) error {
+	suffix, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+	key := "uploads/" + upload.ID + "-" + suffix
+
+	err = app.Storage.Put(ctx, key, bytes.NewReader(data), int64(len(data)), tusContentType)
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().Add(app.UploadExpiry)
+
+	ok, err := app.DB.AppendUploadPart(upload.ID, upload.Offset, int64(len(data)), key, expiresAt)
+	if err == nil && !ok {
+		err = &statusError{http.StatusConflict, errors.New("upload was resumed concurrently")}
+	}
+	if err != nil {
+		_ = app.Storage.Delete(ctx, key)
+		return err
+	}
+
+	upload.Offset += int64(len(data))
+	upload.Parts = append(upload.Parts, key)
+	upload.ExpiresAt = expiresAt
+
+	return nil
+}
+
+// finishUpload joins the parts of a complete upload into an image, creates its meme and
+// deletes the parts. If the image is refused, the upload is left for the client to
+// delete, or to expire.
+func (app *Application) finishUpload(ctx context.Context, upload *models.Upload) error {
+	var data bytes.Buffer
+	data.Grow(int(upload.Length))
+
+	for _, key := range upload.Parts {
+		blob, err := app.Storage.Get(ctx, key)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", key, err)
+		}
+		_, err = io.Copy(&data, blob)
+		blob.Close()
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", key, err)
+		}
+	}
+
+	contentType, ext, err := sniffImage(data.Bytes())
+	if err != nil {
+		return err
+	}
+
+	meme, err := uploadedMeme(metadataField(upload.Metadata))
+	if err != nil {
+		return &statusError{http.StatusBadRequest, err}
+	}
+	if upload.OwnerID != 0 {
+		meme.OwnerID = &upload.OwnerID
+	}
+
+	md := imaging.ReadMetadata(data.Bytes())
+	meme.CapturedAt = md.CapturedAt
+
+	err = uploadCoordinates(upload.Metadata["lat"], upload.Metadata["lon"], md, &meme)
+	if err != nil {
+		return &statusError{http.StatusBadRequest, err}
+	}
+
+	err = app.createMeme(ctx, data.Bytes(), contentType, ext, &meme)
+	if err != nil {
+		return err
+	}
+
+	err = app.DB.CompleteUpload(upload.ID, meme.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range upload.Parts {
+		err := app.Storage.Delete(ctx, key)
+		if err != nil {
+			log.Printf("uploads: deleting %s: %v", key, err)
+		}
+	}
+
+	upload.MemeID = &meme.ID
+	upload.Parts = nil
+
+	return nil
+}
+
+// writeUploadHeaders sets the headers describing an upload's progress on a response.
+func writeUploadHeaders(w http.ResponseWriter, upload *models.Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if upload.MemeID != nil {
+		w.Header().Set("Meme-ID", strconv.Itoa(*upload.MemeID))
+	}
+}
+
+// parseUploadMetadata parses a tus Upload-Metadata header: comma-separated pairs of a key
+// and a base64 encoded value, which may be left out.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("Upload-Metadata has an empty key")
+		}
+		if _, ok := metadata[key]; ok {
+			return nil, fmt.Errorf("Upload-Metadata has key %s twice", key)
+		}
+
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("Upload-Metadata value of %s is not base64", key)
+		}
+
+		metadata[key] = string(value)
+	}
+
+	return metadata, nil
+}
+
+// metadataField looks up fields of parsed Upload-Metadata, for uploadedMeme.
+func metadataField(metadata map[string]string) func(string) string {
+	return func(key string) string {
+		return metadata[key]
+	}
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,408 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sdblg/meme/pkg/imaging"
+	"github.com/sdblg/meme/pkg/models"
+	"github.com/sdblg/meme/pkg/repository"
+	"github.com/sdblg/meme/pkg/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Duplicate policies decide what happens to an upload that looks like an existing meme:
+// it is refused, accepted with duplicate_of pointing at the existing meme, or accepted
+// without checking.
+const (
+	duplicatePolicyReject = "reject"
+	duplicatePolicyFlag   = "flag"
+	duplicatePolicyOff    = "off"
+)
+
+// ValidateDuplicatePolicy checks that app.DuplicatePolicy is one of the known policies, so
+// that a mistyped one is not silently treated as flag.
+func (app *Application) ValidateDuplicatePolicy() error {
+	switch app.DuplicatePolicy {
+	case duplicatePolicyReject, duplicatePolicyFlag, duplicatePolicyOff:
+		return nil
+	default:
+		return fmt.Errorf(
+			"unknown duplicate policy %q: must be reject, flag or off",
+			app.DuplicatePolicy,
+		)
+	}
+}
+
+// uploadMemory is how much of a multipart upload is held in memory before the rest is
+// spooled to temporary files.
+const uploadMemory = 4 << 20
+
+// imageExtensions maps the image content types accepted for upload to the file extension
+// they are stored under.
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// UploadMeme receives a multipart form with an image file and lat/lon fields, stores the
+// image and inserts a meme, owned by the current user, pointing at a copy of it with EXIF
+// metadata stripped.
+//
+// If lat and lon are left out, they are read from the image's EXIF GPS tags instead, along
+// with the capture time. An optional visibility field makes the meme private or pending
+// instead of public, and title, caption, alt_text and tags (comma-separated) fields
+// describe it. The image type is decided by sniffing its bytes, not by trusting
+// the client's Content-Type. Images that look like an existing meme are rejected or
+// flagged, according to app.DuplicatePolicy. Uploads are limited to app.MaxUploadBytes
+// rather than the 1MB JSON body limit.
+func (app *Application) UploadMeme(w http.ResponseWriter, r *http.Request) {
+	user, err := app.currentUser(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = app.parseUploadForm(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer func() {
+		_ = r.MultipartForm.RemoveAll()
+	}()
+
+	data, contentType, ext, err := formImage(r, "image")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	meme, err := uploadedMeme(r.FormValue)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+	meme.OwnerID = &user.ID
+
+	md := imaging.ReadMetadata(data)
+	meme.CapturedAt = md.CapturedAt
+
+	err = uploadCoordinates(r.FormValue("lat"), r.FormValue("lon"), md, &meme)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	err = app.createMeme(r.Context(), data, contentType, ext, &meme)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: fmt.Sprintf("meme inserted with id: %d", meme.ID),
+		Data:    app.signMeme(&meme),
+	}
+
+	_ = utils.WriteJSON(w, http.StatusAccepted, resp)
+}
+
+// uploadedMeme returns a new meme with the visibility and description sent along with an
+// uploaded image, looked up by field: form values for multipart uploads, or
+// Upload-Metadata for resumable ones.
+func uploadedMeme(field func(string) string) (models.Meme, error) {
+	meme := models.Meme{
+		Visibility: field("visibility"),
+		Title:      field("title"),
+		Caption:    field("caption"),
+		AltText:    field("alt_text"),
+	}
+
+	var err error
+	meme.Tags, err = models.SplitTags(field("tags"))
+	if err != nil {
+		return models.Meme{}, err
+	}
+
+	return meme, nil
+}
+
+// parseUploadForm parses a multipart upload, limited to app.MaxUploadBytes rather than the
+// 1MB JSON body limit. On success the caller must remove r.MultipartForm's temporary files.
+func (app *Application) parseUploadForm(w http.ResponseWriter, r *http.Request) error {
+	r.Body = http.MaxBytesReader(w, r.Body, app.MaxUploadBytes)
+
+	err := r.ParseMultipartForm(uploadMemory)
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return &statusError{
+				http.StatusRequestEntityTooLarge,
+				fmt.Errorf("upload must not be larger than %d bytes", app.MaxUploadBytes),
+			}
+		}
+		return &statusError{http.StatusBadRequest, err}
+	}
+
+	return nil
+}
+
+// formImage reads the image file in the named field of a parsed multipart form, returning
+// its bytes with the content type sniffed from them and the extension it is stored under.
+func formImage(r *http.Request, field string) ([]byte, string, string, error) {
+	file, _, err := r.FormFile(field)
+	if err != nil {
+		return nil, "", "", &statusError{
+			http.StatusBadRequest,
+			fmt.Errorf("%s file is required", field),
+		}
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, "", "", &statusError{http.StatusBadRequest, err}
+	}
+
+	contentType, ext, err := sniffImage(data)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return data, contentType, ext, nil
+}
+
+// sniffImage returns the content type of an uploaded image, sniffed from its bytes, and
+// the extension it is stored under.
+func sniffImage(data []byte) (string, string, error) {
+	contentType := http.DetectContentType(data)
+	ext, ok := imageExtensions[contentType]
+	if !ok {
+		return "", "", &statusError{
+			http.StatusUnsupportedMediaType,
+			fmt.Errorf("unsupported image type %s", contentType),
+		}
+	}
+
+	return contentType, ext, nil
+}
+
+// createMeme turns an uploaded or generated image into a meme: it checks the image for
+// duplicates, stores it, inserts meme pointing at it and queues its resized variants.
+// meme must already have its coordinates; its ID, Image, hashes and media details are
+// filled in. Animations are hashed by their first frame. Errors that the client should see
+// carry their HTTP status, for writeError.
+func (app *Application) createMeme(
+	ctx context.Context,
+	data []byte,
+	contentType, ext string,
+	meme *models.Meme,
+) error {
+	info, err := probeImage(data)
+	if err != nil {
+		return err
+	}
+
+	img, _, err := imaging.Decode(data)
+	if err != nil {
+		return &statusError{http.StatusBadRequest, errors.New("image could not be decoded")}
+	}
+
+	// The size, hash and blurhash describe the stored copy, which is only rotated upright
+	// when its metadata is stripped if it is a JPEG with an EXIF orientation.
+	orientation := imaging.StrippedOrientation(data)
+
+	meme.MediaType = contentType
+	meme.Width, meme.Height = info.Width, info.Height
+	if orientation >= 5 {
+		// The stored copy is rotated upright, which swaps the axes.
+		meme.Width, meme.Height = info.Height, info.Width
+	}
+	meme.FrameCount, meme.DurationMS = info.FrameCount, info.DurationMS
+
+	oriented := imaging.Orient(img, orientation)
+
+	hash := int64(imaging.DHash(oriented))
+	meme.PHash = &hash
+	meme.BlurHash = imaging.BlurHash(oriented)
+
+	dup, err := app.findDuplicate(hash, meme.OwnerID)
+	if err != nil {
+		return err
+	}
+	if dup != nil {
+		if app.DuplicatePolicy == duplicatePolicyReject {
+			return &statusError{
+				http.StatusConflict,
+				fmt.Errorf("image is a duplicate of meme %d", dup.ID),
+			}
+		}
+		meme.DuplicateOf = &dup.ID
+	}
+
+	key, err := app.storeImage(ctx, data, contentType, ext)
+	if err != nil {
+		return err
+	}
+
+	meme.Image = models.ImagePath(key)
+
+	meme.CreatedAt = time.Now()
+	meme.UpdatedAt = time.Now()
+
+	meme.ID, err = app.DB.InsertMeme(*meme)
+	if err != nil {
+		return err
+	}
+
+	// Resized variants are generated in the background; they appear on the meme once done.
+	app.Variants.Enqueue(meme.ID)
+
+	return nil
+}
+
+// probeImage reads an uploaded image's size and timing with imaging.Probe, which must
+// pass before the image is decoded. Errors carry their HTTP status, for writeError.
+func probeImage(data []byte) (imaging.Info, error) {
+	info, err := imaging.Probe(data)
+	if err != nil {
+		if errors.Is(err, imaging.ErrImageTooLarge) ||
+			errors.Is(err, imaging.ErrAnimationTooLarge) {
+			return imaging.Info{}, &statusError{http.StatusRequestEntityTooLarge, err}
+		}
+		return imaging.Info{}, &statusError{
+			http.StatusBadRequest,
+			errors.New("image could not be decoded"),
+		}
+	}
+
+	return info, nil
+}
+
+// findDuplicate returns the most similar existing meme whose perceptual hash is within
+// app.DuplicateDistance bits of hash, or nil if there is none or duplicate detection is
+// off. Only public memes and those of the uploader, ownerID, are searched, so neither a
+// rejection nor duplicate_of gives away someone else's private or pending meme.
+func (app *Application) findDuplicate(hash int64, ownerID *int) (*models.SimilarMeme, error) {
+	if app.DuplicatePolicy == duplicatePolicyOff {
+		return nil, nil
+	}
+
+	owner := 0
+	if ownerID != nil {
+		owner = *ownerID
+	}
+
+	similar, err := app.DB.SimilarMemes(hash, app.DuplicateDistance, 0, 1, owner)
+	if err != nil || len(similar) == 0 {
+		return nil, err
+	}
+
+	return similar[0], nil
+}
+
+// storeImage stores an uploaded image twice: the original, untouched, under a private
+// originals/ key for the meme's owner, moderators and admins, and a copy stripped of EXIF
+// and other metadata under the public key it returns. Keys are derived from the original's
+// content, so re-uploading the same file reuses the stored copies.
+func (app *Application) storeImage(
+	ctx context.Context,
+	data []byte,
+	contentType, ext string,
+) (string, error) {
+	key := fmt.Sprintf("%x%s", sha256.Sum256(data), ext)
+
+	public, err := imaging.StripMetadata(data)
+	if err != nil {
+		return "", fmt.Errorf("stripping image metadata: %w", err)
+	}
+
+	err = app.Storage.Put(
+		ctx,
+		models.OriginalKey(key),
+		bytes.NewReader(data),
+		int64(len(data)),
+		contentType,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	err = app.Storage.Put(ctx, key, bytes.NewReader(public), int64(len(public)), contentType)
+	if err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// GetOriginalImage sends the original upload of a meme's image, with its EXIF metadata
+// intact, to the meme's owner, moderators and admins; the public image has that metadata
+// stripped, as it may give away where the owner lives.
+func (app *Application) GetOriginalImage(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	meme, err := app.changeableMeme(w, r, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	blob, err := app.Storage.Get(r.Context(), models.OriginalKey(meme.ImageKey()))
+	if err != nil {
+		if errors.Is(err, repository.ErrBlobNotFound) {
+			_ = utils.ErrorJSON(w, errors.New("original image not found"), http.StatusNotFound)
+			return
+		}
+		_ = utils.ErrorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", blob.ContentType)
+	w.Header().Set("Cache-Control", "private, no-store")
+
+	http.ServeContent(w, r, "", blob.ModTime, blob)
+}
+
+// uploadCoordinates sets meme's coordinates from the lat and lon form values or, if both
+// are empty, from the GPS position in the image's EXIF metadata.
+func uploadCoordinates(lat, lon string, md imaging.Metadata, meme *models.Meme) error {
+	var err error
+
+	if lat == "" && lon == "" {
+		if !md.HasLocation {
+			return errors.New("lat and lon are required when the image has no EXIF GPS position")
+		}
+		meme.Lan, meme.Lon = md.Lat, md.Lon
+		return meme.Validate()
+	}
+
+	meme.Lan, err = strconv.ParseFloat(lat, 64)
+	if err != nil {
+		return models.ErrInvalidLatitude
+	}
+
+	meme.Lon, err = strconv.ParseFloat(lon, 64)
+	if err != nil {
+		return models.ErrInvalidLongitude
+	}
+
+	return meme.Validate()
+}
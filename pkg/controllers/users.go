@@ -0,0 +1,148 @@
+package controllers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/sdblg/meme/pkg/models"
+	"github.com/sdblg/meme/pkg/utils"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// currentUser returns the user that the request's access token was issued to, with the
+// role recorded in the token, or a 401 error if there is no valid token. Only the ID and
+// role are filled in.
+func (app *Application) currentUser(w http.ResponseWriter, r *http.Request) (*models.User, error) {
+	_, claims, err := app.Auth.GetTokenFromHeaderAndVerify(w, r)
+	if err != nil {
+		return nil, &statusError{http.StatusUnauthorized, errors.New("unauthorized")}
+	}
+
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, &statusError{http.StatusUnauthorized, errors.New("unauthorized")}
+	}
+
+	return &models.User{ID: id, Role: claims.Role}, nil
+}
+
+// changeableMeme returns the meme with the given ID if the current user may update or
+// delete it, a 404 error if there is no such meme, and a 403 error if it belongs to
+// someone else and they are not a moderator or admin.
+func (app *Application) changeableMeme(
+	w http.ResponseWriter,
+	r *http.Request,
+	id int,
+) (*models.Meme, error) {
+	user, err := app.currentUser(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	meme, err := app.DB.OneMeme(id)
+	if err != nil {
+		return nil, &statusError{http.StatusNotFound, errors.New("meme not found")}
+	}
+
+	if !user.CanChange(meme) {
+		return nil, &statusError{
+			http.StatusForbidden,
+			errors.New("only the meme's owner, moderators and admins may change it"),
+		}
+	}
+
+	return meme, nil
+}
+
+// UserMemes returns the memes owned by a user, newest first, as JSON or GeoJSON. Anyone
+// may list a user's public memes; the user themselves, moderators and admins also get
+// their private and pending ones, with signed image URLs.
+func (app *Application) UserMemes(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	w.Header().Add("Vary", "Authorization")
+
+	publicOnly := true
+	if r.Header.Get("Authorization") != "" {
+		user, err := app.currentUser(w, r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		publicOnly = user.ID != id && !user.CanModerate()
+	}
+
+	memes, err := app.DB.MemesByOwner(id, publicOnly)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	for i, meme := range memes {
+		memes[i] = app.signMeme(meme)
+	}
+
+	writeMemes(w, r, memes)
+}
+
+// UpdateUserRole changes a user's role, from a JSON payload such as {"role": "moderator"}.
+// The user's access tokens keep their old role until they are refreshed. Admins may not
+// change their own role, so that there is always one left.
+func (app *Application) UpdateUserRole(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	var payload struct {
+		Role string `json:"role"`
+	}
+
+	err = utils.ReadJSON(w, r, &payload)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	err = models.ValidateRole(payload.Role)
+	if err != nil {
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	user, err := app.currentUser(w, r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if user.ID == id {
+		_ = utils.ErrorJSON(w, errors.New("admins may not change their own role"))
+		return
+	}
+
+	err = app.DB.UpdateUserRole(id, payload.Role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			_ = utils.ErrorJSON(w, errors.New("user not found"), http.StatusNotFound)
+			return
+		}
+		_ = utils.ErrorJSON(w, err)
+		return
+	}
+
+	resp := utils.JSONResponse{
+		Error:   false,
+		Message: "role updated",
+	}
+
+	_ = utils.WriteJSON(w, http.StatusAccepted, resp)
+}
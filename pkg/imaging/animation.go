@@ -0,0 +1,304 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+)
+
+// MaxImagePixels caps the canvas area of the images the service accepts, since decoding
+// one allocates its full canvas whatever the size of the file.
+const MaxImagePixels = 48 << 20
+
+// MaxAnimationPixels caps the frame count times canvas area of the animations the service
+// accepts, since every frame is decoded in full to resize or caption it.
+const MaxAnimationPixels = 100 << 20
+
+var (
+	// ErrImageTooLarge is returned by Probe for images over MaxImagePixels.
+	ErrImageTooLarge = errors.New("imaging: image is too large")
+
+	// ErrAnimationTooLarge is returned by Probe for animations over MaxAnimationPixels.
+	ErrAnimationTooLarge = errors.New("imaging: animation has too many frames for its size")
+)
+
+// errStopFrames ends eachFrame early without an error.
+var errStopFrames = errors.New("imaging: stop frames")
+
+// Info is the size and timing of an image. Stills have a FrameCount of 1 and no duration.
+type Info struct {
+	Width      int
+	Height     int
+	FrameCount int
+	DurationMS int
+}
+
+// Animated reports whether the image has more than one frame.
+func (i Info) Animated() bool {
+	return i.FrameCount > 1
+}
+
+// Probe reads the canvas size, frame count and total duration of a JPEG, PNG, GIF or
+// WebP image from its headers, without decoding any pixels. It returns ErrImageTooLarge
+// or ErrAnimationTooLarge for images too large to decode safely, so it must be called
+// before decoding untrusted images.
+func Probe(data []byte) (Info, error) {
+	info := Info{FrameCount: 1}
+
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		var err error
+		info, err = probeGIF(data)
+		if err != nil {
+			return Info{}, err
+		}
+	case isAnimatedWebP(data):
+		anim, err := parseWebPAnimation(data)
+		if err != nil {
+			return Info{}, err
+		}
+		info = Info{Width: anim.width, Height: anim.height, FrameCount: len(anim.frames)}
+		for _, f := range anim.frames {
+			info.DurationMS += f.delayMS
+		}
+	default:
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return Info{}, err
+		}
+		info.Width, info.Height = cfg.Width, cfg.Height
+	}
+
+	// Compare by division, so that huge sizes in headers cannot overflow.
+	if info.Width <= 0 || info.Height <= 0 {
+		return Info{}, errors.New("imaging: image has no pixels")
+	}
+	if info.Width > MaxImagePixels/info.Height {
+		return Info{}, ErrImageTooLarge
+	}
+	if info.FrameCount > MaxAnimationPixels/(info.Width*info.Height) {
+		return Info{}, ErrAnimationTooLarge
+	}
+
+	return info, nil
+}
+
+// probeGIF counts the image descriptors of a GIF and adds up the delays in their graphic
+// control extensions.
+func probeGIF(data []byte) (Info, error) {
+	if len(data) < 13 {
+		return Info{}, errTruncated
+	}
+
+	info := Info{
+		Width:  int(binary.LittleEndian.Uint16(data[6:])),
+		Height: int(binary.LittleEndian.Uint16(data[8:])),
+	}
+
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 << (data[10]&0x07 + 1)
+	}
+
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x3b: // trailer
+			pos = len(data)
+		case 0x21: // extension
+			if pos+2 > len(data) {
+				return Info{}, errTruncated
+			}
+			if data[pos+1] == 0xf9 && pos+6 <= len(data) {
+				// Graphic control extension: size, packed fields, delay in 1/100s.
+				info.DurationMS += 10 * int(binary.LittleEndian.Uint16(data[pos+4:]))
+			}
+			end, err := gifSubBlocksEnd(data, pos+2)
+			if err != nil {
+				return Info{}, err
+			}
+			pos = end
+		case 0x2c: // image descriptor
+			if pos+10 > len(data) {
+				return Info{}, errTruncated
+			}
+			packed := data[pos+9]
+			pos += 10
+			if packed&0x80 != 0 {
+				pos += 3 << (packed&0x07 + 1)
+			}
+			end, err := gifSubBlocksEnd(data, pos+1)
+			if err != nil {
+				return Info{}, err
+			}
+			pos = end
+			info.FrameCount++
+		default:
+			return Info{}, errors.New("imaging: invalid GIF block")
+		}
+	}
+
+	if info.FrameCount == 0 {
+		return Info{}, errors.New("imaging: GIF has no frames")
+	}
+
+	return info, nil
+}
+
+// RenderAnimation decodes an animated GIF or WebP, passes every frame through fn and
+// encodes the results as an animated GIF, keeping each frame's delay and the loop count.
+// fn gets the frame composited onto the full canvas and must return images of the same
+// size for every frame; it must not keep the image it is given.
+//
+// The result is always a GIF, since there is no WebP encoder available, so colours are
+// reduced to a 256-colour palette per frame.
+func RenderAnimation(
+	data []byte,
+	fn func(image.Image) image.Image,
+) ([]byte, string, string, error) {
+	var enc gifEncoder
+
+	loopCount, err := eachFrame(data, func(canvas *image.RGBA, delayMS int) error {
+		enc.add(fn(canvas), delayMS)
+		return nil
+	})
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	out, err := enc.encode(loopCount)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return out, "image/gif", ".gif", nil
+}
+
+// decodeFirstFrame decodes the first frame of an animated WebP.
+func decodeFirstFrame(data []byte) (image.Image, error) {
+	var first *image.RGBA
+
+	_, err := eachFrame(data, func(canvas *image.RGBA, _ int) error {
+		first = cloneRGBA(canvas)
+		return errStopFrames
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return first, nil
+}
+
+// eachFrame decodes an animated GIF or WebP and calls fn with every frame composited onto
+// the full canvas, as a viewer would show it, along with the frame's delay in
+// milliseconds. The canvas is reused between calls. It returns the loop count: 0 for
+// forever, otherwise the number of times the animation plays.
+func eachFrame(data []byte, fn func(canvas *image.RGBA, delayMS int) error) (int, error) {
+	var (
+		loopCount int
+		err       error
+	)
+
+	if isAnimatedWebP(data) {
+		loopCount, err = eachWebPFrame(data, fn)
+	} else {
+		loopCount, err = eachGIFFrame(data, fn)
+	}
+	if errors.Is(err, errStopFrames) {
+		err = nil
+	}
+
+	return loopCount, err
+}
+
+// eachGIFFrame is eachFrame for GIFs, applying each frame's disposal method.
+func eachGIFFrame(data []byte, fn func(canvas *image.RGBA, delayMS int) error) (int, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+
+	// A GIF's loop count is the number of repeats, with 0 for forever and -1 for none.
+	loopCount := 0
+	switch {
+	case g.LoopCount < 0:
+		loopCount = 1
+	case g.LoopCount > 0:
+		loopCount = g.LoopCount + 1
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		err := fn(canvas, 10*g.Delay[i])
+		if err != nil {
+			return 0, err
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(canvas.Pix, previous.Pix)
+		}
+	}
+
+	return loopCount, nil
+}
+
+// eachWebPFrame is eachFrame for animated WebPs, applying each frame's blending and
+// disposal. The ANIM background colour is ignored and the canvas starts transparent, as
+// browsers do.
+func eachWebPFrame(data []byte, fn func(canvas *image.RGBA, delayMS int) error) (int, error) {
+	anim, err := parseWebPAnimation(data)
+	if err != nil {
+		return 0, err
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, anim.width, anim.height))
+
+	for _, f := range anim.frames {
+		img, err := decodeWebPFrame(f)
+		if err != nil {
+			return 0, err
+		}
+
+		op := draw.Over
+		if !f.blend {
+			op = draw.Src
+		}
+		draw.Draw(canvas, f.rect, img, img.Bounds().Min, op)
+
+		err = fn(canvas, f.delayMS)
+		if err != nil {
+			return 0, err
+		}
+
+		if f.dispose {
+			draw.Draw(canvas, f.rect, image.Transparent, image.Point{}, draw.Src)
+		}
+	}
+
+	return anim.loopCount, nil
+}
+
+// cloneRGBA returns a copy of img.
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	dst := image.NewRGBA(img.Bounds())
+	copy(dst.Pix, img.Pix)
+	return dst
+}
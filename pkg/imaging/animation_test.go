@@ -0,0 +1,111 @@
+package imaging
+
+import (
+	"errors"
+	"image"
+	"testing"
+)
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want Info
+		err  error
+	}{
+		{"png", pngHeader(640, 480), Info{Width: 640, Height: 480, FrameCount: 1}, nil},
+		{
+			"png at the limit",
+			pngHeader(8192, 6144),
+			Info{Width: 8192, Height: 6144, FrameCount: 1},
+			nil,
+		},
+		{"png too large", pngHeader(8192, 6145), Info{}, ErrImageTooLarge},
+		{"gif", gifFrames(10, 10, 3), Info{Width: 10, Height: 10, FrameCount: 3}, nil},
+		{"gif too many frames", gifFrames(1024, 1024, 101), Info{}, ErrAnimationTooLarge},
+		{"gif too large", gifFrames(65535, 65535, 1), Info{}, ErrImageTooLarge},
+		{
+			"webp animation",
+			animWebP(8, 8, anmf(0, 0, 8, 8, vp8l(8, 8)), anmf(2, 2, 4, 4, vp8l(4, 4))),
+			Info{Width: 8, Height: 8, FrameCount: 2, DurationMS: 200},
+			nil,
+		},
+		{
+			"webp canvas too large",
+			animWebP(10000, 10000, anmf(0, 0, 8, 8, vp8l(8, 8))),
+			Info{},
+			ErrImageTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := Probe(tt.data)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("Probe error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Probe: %v", err)
+			}
+			if info != tt.want {
+				t.Errorf("Probe = %+v, want %+v", info, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeRejectsMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"png huge", pngHeader(1<<31-1, 1<<31-1)},
+		{"gif without pixels", gifFrames(0, 10, 1)},
+		{"gif without frames", gifFrames(10, 10, 0)},
+		{"webp frame outside canvas", animWebP(8, 8, anmf(0, 0, 16, 16, vp8l(16, 16)))},
+		{"webp frame past canvas edge", animWebP(8, 8, anmf(6, 6, 4, 4, vp8l(4, 4)))},
+		{"webp without frames", animWebP(8, 8)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Probe(tt.data)
+			if err == nil {
+				t.Error("Probe accepted the image")
+			}
+		})
+	}
+}
+
+func TestWebPFrameMustMatchItsBitstream(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"matching", animWebP(8, 8, anmf(0, 0, 8, 8, vp8l(8, 8))), true},
+		// The ANMF header is checked against the canvas, but the bitstream inside it
+		// could claim any size; it must not be decoded.
+		{"bitstream larger", animWebP(8, 8, anmf(0, 0, 8, 8, vp8l(16000, 16000))), false},
+		{"bitstream smaller", animWebP(8, 8, anmf(0, 0, 8, 8, vp8l(4, 4))), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames := 0
+			_, err := eachFrame(tt.data, func(*image.RGBA, int) error {
+				frames++
+				return nil
+			})
+			if tt.ok && (err != nil || frames != 1) {
+				t.Errorf("eachFrame decoded %d frames, error %v, want 1 frame", frames, err)
+			}
+			if !tt.ok && err == nil {
+				t.Error("eachFrame decoded a frame that does not match its header")
+			}
+		})
+	}
+}
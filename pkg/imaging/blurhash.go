@@ -0,0 +1,136 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+)
+
+// blurHashSampleWidth is the width images are scaled down to before computing their
+// BlurHash. The hash only keeps a few colour components, so more pixels change nothing
+// but the time it takes.
+const blurHashSampleWidth = 32
+
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// BlurHash returns the BlurHash (https://blurha.sh) of img: a short string that clients
+// decode into a blurred placeholder while the image loads. It uses 4x3 components for
+// landscape images and 3x4 for portrait ones. Transparent areas are treated as white.
+func BlurHash(img image.Image) string {
+	b := img.Bounds()
+	nx, ny := 4, 3
+	if b.Dy() > b.Dx() {
+		nx, ny = 3, 4
+	}
+
+	sample := img
+	if b.Dx() > blurHashSampleWidth {
+		sample = Resize(img, blurHashSampleWidth)
+	}
+	flat := image.NewRGBA(image.Rect(0, 0, sample.Bounds().Dx(), sample.Bounds().Dy()))
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), sample, sample.Bounds().Min, draw.Over)
+
+	w, h := flat.Bounds().Dx(), flat.Bounds().Dy()
+
+	// Linear RGB of every pixel, computed once for all components.
+	linear := make([][3]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := flat.Pix[flat.PixOffset(x, y):]
+			linear[y*w+x] = [3]float64{
+				sRGBToLinear(p[0]),
+				sRGBToLinear(p[1]),
+				sRGBToLinear(p[2]),
+			}
+		}
+	}
+
+	factors := make([][3]float64, 0, nx*ny)
+	for j := 0; j < ny; j++ {
+		for i := 0; i < nx; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := norm *
+						math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(h))
+					for c := 0; c < 3; c++ {
+						f[c] += basis * linear[y*w+x][c]
+					}
+				}
+			}
+			for c := 0; c < 3; c++ {
+				f[c] /= float64(w * h)
+			}
+
+			factors = append(factors, f)
+		}
+	}
+
+	var hash strings.Builder
+	encode83(&hash, (nx-1)+(ny-1)*9, 1)
+
+	maxAC := 0.0
+	for _, f := range factors[1:] {
+		for c := 0; c < 3; c++ {
+			maxAC = math.Max(maxAC, math.Abs(f[c]))
+		}
+	}
+
+	acScale := 1.0
+	if len(factors) > 1 {
+		quantised := int(math.Max(0, math.Min(82, math.Floor(maxAC*166-0.5))))
+		acScale = float64(quantised+1) / 166
+		encode83(&hash, quantised, 1)
+	} else {
+		encode83(&hash, 0, 1)
+	}
+
+	dc := factors[0]
+	encode83(&hash, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+
+	for _, f := range factors[1:] {
+		q := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/acScale, 0.5)*9+9.5))))
+		}
+		encode83(&hash, q(f[0])*19*19+q(f[1])*19+q(f[2]), 2)
+	}
+
+	return hash.String()
+}
+
+// encode83 appends value to hash as length base 83 digits.
+func encode83(hash *strings.Builder, value, length int) {
+	for i := 1; i <= length; i++ {
+		digit := value / int(math.Pow(83, float64(length-i))) % 83
+		hash.WriteByte(base83[digit])
+	}
+}
+
+func sRGBToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
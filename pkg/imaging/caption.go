@@ -0,0 +1,205 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// minFontSize is the smallest size, in pixels, that captions are shrunk to when they do
+// not fit their box.
+const minFontSize = 8
+
+// Caption is text to draw inside a box of a template image. FontSize is the largest size
+// to use, in pixels; text that does not fit the box at that size is shrunk. Align is
+// "left", "center" or "right". The text is outlined with StrokeColor, StrokeWidth pixels
+// wide, so that it stays legible on any background.
+type Caption struct {
+	Text        string
+	Box         image.Rectangle
+	FontSize    float64
+	Align       string
+	Color       color.Color
+	StrokeColor color.Color
+	StrokeWidth int
+}
+
+var (
+	captionFont     *opentype.Font
+	captionFontErr  error
+	captionFontOnce sync.Once
+)
+
+// loadCaptionFont parses the embedded Go Bold font, once.
+func loadCaptionFont() (*opentype.Font, error) {
+	captionFontOnce.Do(func() {
+		captionFont, captionFontErr = opentype.Parse(gobold.TTF)
+	})
+
+	return captionFont, captionFontErr
+}
+
+// RenderCaptions draws captions onto a transparent overlay of the given size, ready to be
+// composited onto a template with DrawOverlay. Rendering the overlay once lets the same
+// captions be drawn onto every frame of an animation cheaply.
+func RenderCaptions(bounds image.Rectangle, captions []Caption) (*image.RGBA, error) {
+	f, err := loadCaptionFont()
+	if err != nil {
+		return nil, err
+	}
+
+	overlay := image.NewRGBA(bounds)
+
+	for _, c := range captions {
+		err := renderCaption(overlay, f, c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return overlay, nil
+}
+
+// DrawOverlay returns a copy of img with overlay composited on top of it.
+func DrawOverlay(img image.Image, overlay image.Image) *image.RGBA {
+	out := image.NewRGBA(img.Bounds())
+	draw.Draw(out, out.Bounds(), img, img.Bounds().Min, draw.Src)
+	draw.Draw(out, out.Bounds(), overlay, overlay.Bounds().Min, draw.Over)
+
+	return out
+}
+
+// renderCaption word-wraps one caption to its box, shrinking the font until the lines fit,
+// and draws it centred vertically in the box.
+func renderCaption(dst *image.RGBA, f *opentype.Font, c Caption) error {
+	words := strings.Fields(c.Text)
+	if len(words) == 0 {
+		return nil
+	}
+
+	width := c.Box.Dx() - 2*c.StrokeWidth
+	height := c.Box.Dy() - 2*c.StrokeWidth
+
+	var face font.Face
+	var lines []string
+
+	for size := c.FontSize; ; size *= 0.9 {
+		if size < minFontSize {
+			size = minFontSize
+		}
+
+		var err error
+		face, err = opentype.NewFace(f, &opentype.FaceOptions{
+			Size:    size,
+			DPI:     72,
+			Hinting: font.HintingFull,
+		})
+		if err != nil {
+			return err
+		}
+
+		var fits bool
+		lines, fits = wrapWords(face, words, width)
+		if fits && len(lines)*face.Metrics().Height.Ceil() <= height || size == minFontSize {
+			break
+		}
+		face.Close()
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+	top := c.Box.Min.Y + (c.Box.Dy()-len(lines)*lineHeight)/2
+
+	fill := &font.Drawer{Dst: dst, Src: image.NewUniform(c.Color), Face: face}
+	stroke := &font.Drawer{Dst: dst, Src: image.NewUniform(c.StrokeColor), Face: face}
+
+	for i, line := range lines {
+		lineWidth := font.MeasureString(face, line).Ceil()
+
+		x := c.Box.Min.X + (c.Box.Dx()-lineWidth)/2
+		switch c.Align {
+		case "left":
+			x = c.Box.Min.X + c.StrokeWidth
+		case "right":
+			x = c.Box.Max.X - c.StrokeWidth - lineWidth
+		}
+		y := top + i*lineHeight + metrics.Ascent.Ceil()
+
+		// The outline is the text drawn at every offset within StrokeWidth of the
+		// baseline position, with the fill drawn over it.
+		sw := c.StrokeWidth
+		for dy := -sw; dy <= sw; dy++ {
+			for dx := -sw; dx <= sw; dx++ {
+				if dx*dx+dy*dy > sw*sw || (dx == 0 && dy == 0) {
+					continue
+				}
+				stroke.Dot = fixed.P(x+dx, y+dy)
+				stroke.DrawString(line)
+			}
+		}
+
+		fill.Dot = fixed.P(x, y)
+		fill.DrawString(line)
+	}
+
+	return nil
+}
+
+// wrapWords greedily packs words into lines no wider than width. It reports false if some
+// word is wider than width on its own.
+func wrapWords(face font.Face, words []string, width int) ([]string, bool) {
+	var lines []string
+	fits := true
+
+	line := words[0]
+	for _, word := range words[1:] {
+		candidate := line + " " + word
+		if font.MeasureString(face, candidate).Ceil() <= width {
+			line = candidate
+			continue
+		}
+		lines = append(lines, line)
+		line = word
+	}
+	lines = append(lines, line)
+
+	for _, l := range lines {
+		if font.MeasureString(face, l).Ceil() > width {
+			fits = false
+		}
+	}
+
+	return lines, fits
+}
+
+// ParseHexColor parses a colour written as #rrggbb or #rrggbbaa.
+func ParseHexColor(s string) (color.RGBA, error) {
+	if !strings.HasPrefix(s, "#") || (len(s) != 7 && len(s) != 9) {
+		return color.RGBA{}, fmt.Errorf("invalid colour %q", s)
+	}
+
+	v, err := strconv.ParseUint(s[1:], 16, 32)
+	if err != nil {
+		return color.RGBA{}, fmt.Errorf("invalid colour %q", s)
+	}
+
+	if len(s) == 7 {
+		v = v<<8 | 0xff
+	}
+
+	// color.RGBA is alpha-premultiplied.
+	c := color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}
+	r, g, b, a := c.RGBA()
+
+	return color.RGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8), A: uint8(a >> 8)}, nil
+}
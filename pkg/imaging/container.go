@@ -0,0 +1,98 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+	errTruncated = errors.New("imaging: truncated image")
+)
+
+// chunk is one chunk of a PNG or RIFF (WebP) file. data[start:end] is the whole chunk,
+// header and padding included, and body is its payload.
+type chunk struct {
+	kind  string
+	start int
+	end   int
+	body  []byte
+}
+
+// isPNG reports whether data starts with the PNG signature.
+func isPNG(data []byte) bool {
+	return bytes.HasPrefix(data, pngSignature)
+}
+
+// isWebP reports whether data is a RIFF WEBP file.
+func isWebP(data []byte) bool {
+	return len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+// pngChunks splits a PNG file into its chunks. Each chunk is a big-endian length, a
+// four-letter type, the payload and a CRC.
+func pngChunks(data []byte) ([]chunk, error) {
+	var chunks []chunk
+
+	for pos := len(pngSignature); pos < len(data); {
+		if pos+8 > len(data) {
+			return nil, errTruncated
+		}
+
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errTruncated
+		}
+
+		chunks = append(chunks, chunk{
+			kind:  string(data[pos+4 : pos+8]),
+			start: pos,
+			end:   end,
+			body:  data[pos+8 : pos+8+length],
+		})
+		pos = end
+	}
+
+	return chunks, nil
+}
+
+// riffChunks splits the payload of a RIFF WEBP file into its chunks. Each chunk is a
+// four-letter type, a little-endian length and the payload, padded to an even length.
+func riffChunks(data []byte) ([]chunk, error) {
+	return riffChunksFrom(data, 12)
+}
+
+// riffChunksFrom splits data into RIFF chunks starting at pos. It is also used for the
+// chunks nested in an animated WebP's ANMF frames.
+func riffChunksFrom(data []byte, pos int) ([]chunk, error) {
+	var chunks []chunk
+
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return nil, errTruncated
+		}
+
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + length + length%2
+		if length < 0 || pos+8+length > len(data) {
+			return nil, errTruncated
+		}
+		if end > len(data) {
+			// Tolerate a missing pad byte on the final chunk.
+			end = len(data)
+		}
+
+		chunks = append(chunks, chunk{
+			kind:  string(data[pos : pos+4]),
+			start: pos,
+			end:   end,
+			body:  data[pos+8 : pos+8+length],
+		})
+		pos = end
+	}
+
+	return chunks, nil
+}
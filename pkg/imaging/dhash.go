@@ -0,0 +1,29 @@
+package imaging
+
+import (
+	"image"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// DHash returns the 64-bit difference hash of img: the image is shrunk to 9x8 greyscale
+// pixels and each bit records whether a pixel is darker than its right-hand neighbour.
+// Re-encoded, resized or lightly edited copies of an image hash to values only a few bits
+// apart, so the Hamming distance between two hashes measures how alike the images look.
+func DHash(img image.Image) uint64 {
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	xdraw.ApproxBiLinear.Scale(small, small.Bounds(), img, img.Bounds(), xdraw.Src, nil)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		row := small.Pix[y*small.Stride:]
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if row[x] < row[x+1] {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash
+}
@@ -0,0 +1,86 @@
+package imaging
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Metadata is what the service reads from an uploaded image's EXIF data. Orientation is
+// the EXIF orientation, from 1 (upright) to 8, or 0 if the image does not say.
+type Metadata struct {
+	HasLocation bool
+	Lat         float64
+	Lon         float64
+	CapturedAt  *time.Time
+	Orientation int
+}
+
+// ReadMetadata reads the GPS position and original capture time from the EXIF data of a
+// JPEG, PNG or WebP image. Missing or unreadable EXIF data is not an error; the
+// corresponding fields are just left empty.
+func ReadMetadata(data []byte) Metadata {
+	var md Metadata
+
+	raw := exifData(data)
+	if raw == nil {
+		return md
+	}
+
+	x, err := exif.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return md
+	}
+
+	// Cameras without a GPS fix often still write the GPS tags, as 0,0.
+	lat, lon, err := x.LatLong()
+	if err == nil && (lat != 0 || lon != 0) {
+		md.HasLocation = true
+		md.Lat = lat
+		md.Lon = lon
+	}
+
+	capturedAt, err := x.DateTime()
+	if err == nil {
+		md.CapturedAt = &capturedAt
+	}
+
+	tag, err := x.Get(exif.Orientation)
+	if err == nil {
+		md.Orientation, _ = tag.Int(0)
+	}
+
+	return md
+}
+
+// exifData returns the part of an image that exif.Decode can read: a JPEG as a whole, or
+// the raw EXIF block of a PNG eXIf chunk or a WebP EXIF chunk. It returns nil if the image
+// has no EXIF data.
+func exifData(data []byte) []byte {
+	var chunks []chunk
+	var kind string
+	var err error
+
+	switch {
+	case isPNG(data):
+		chunks, err = pngChunks(data)
+		kind = "eXIf"
+	case isWebP(data):
+		chunks, err = riffChunks(data)
+		kind = "EXIF"
+	default:
+		return data
+	}
+	if err != nil {
+		return nil
+	}
+
+	for _, c := range chunks {
+		if c.kind == kind {
+			return c.body
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+// Package imaging decodes, resizes and re-encodes meme images.
+package imaging
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// jpegQuality is used for every JPEG the service encodes.
+const jpegQuality = 85
+
+// Decode decodes a JPEG, PNG, GIF or WebP image. Only the first frame of an animation is
+// returned; RenderAnimation processes all of them.
+func Decode(data []byte) (image.Image, string, error) {
+	if isAnimatedWebP(data) {
+		img, err := decodeFirstFrame(data)
+		return img, "webp", err
+	}
+	return image.Decode(bytes.NewReader(data))
+}
+
+// Resize scales img to the given width, keeping its aspect ratio.
+func Resize(img image.Image, width int) image.Image {
+	b := img.Bounds()
+	height := b.Dy() * width / b.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, b, xdraw.Src, nil)
+
+	return dst
+}
+
+// Encode encodes img for serving. Formats that may carry transparency (PNG, GIF and WebP)
+// are encoded as PNG, everything else as JPEG. It returns the encoded bytes, their content
+// type and the file extension to store them under.
+func Encode(img image.Image, format string) ([]byte, string, string, error) {
+	var buf bytes.Buffer
+
+	switch format {
+	case "png", "gif", "webp":
+		err := png.Encode(&buf, img)
+		if err != nil {
+			return nil, "", "", err
+		}
+		return buf.Bytes(), "image/png", ".png", nil
+	default:
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+		if err != nil {
+			return nil, "", "", err
+		}
+		return buf.Bytes(), "image/jpeg", ".jpg", nil
+	}
+}
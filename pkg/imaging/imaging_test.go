@@ -0,0 +1,236 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// The fixtures below are built in code, so that the tests need no binary files. Each one
+// carries the marker "secret" in its metadata, which stripping must remove.
+
+const secret = "secret"
+
+// testImage returns a w×h image whose pixels encode their coordinates, so that rotations
+// and flips can be told apart.
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 40), G: uint8(y * 40), B: 200, A: 255})
+		}
+	}
+	return img
+}
+
+// exifTIFF returns a big-endian TIFF block with a single IFD holding the orientation and
+// an ImageDescription of "secret".
+func exifTIFF(orientation int) []byte {
+	b := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	b = binary.BigEndian.AppendUint16(b, 2)
+
+	// Orientation, SHORT, 1 value, stored left-justified in the value field.
+	b = binary.BigEndian.AppendUint16(b, 0x0112)
+	b = binary.BigEndian.AppendUint16(b, 3)
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = binary.BigEndian.AppendUint16(b, uint16(orientation))
+	b = binary.BigEndian.AppendUint16(b, 0)
+
+	// ImageDescription, ASCII, stored after the IFD.
+	b = binary.BigEndian.AppendUint16(b, 0x010e)
+	b = binary.BigEndian.AppendUint16(b, 2)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(secret)+1))
+	b = binary.BigEndian.AppendUint32(b, 8+2+2*12+4)
+
+	b = binary.BigEndian.AppendUint32(b, 0)
+	return append(b, secret+"\x00"...)
+}
+
+// jpegWithEXIF encodes a w×h JPEG with an EXIF APP1 segment and a comment.
+func jpegWithEXIF(t *testing.T, w, h, orientation int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, testImage(w, h), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	app1 := append([]byte("Exif\x00\x00"), exifTIFF(orientation)...)
+
+	out := append([]byte(nil), data[:2]...)
+	out = append(out, jpegSegment(0xe1, app1)...)
+	out = append(out, jpegSegment(0xfe, []byte(secret))...)
+	return append(out, data[2:]...)
+}
+
+func jpegSegment(marker byte, body []byte) []byte {
+	out := []byte{0xff, marker}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(body)+2))
+	return append(out, body...)
+}
+
+// pngWithEXIF encodes a w×h PNG with eXIf and tEXt chunks after its header.
+func pngWithEXIF(t *testing.T, w, h, orientation int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, testImage(w, h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// The signature and IHDR chunk come first.
+	ihdrEnd := len(pngSignature) + 12 + 13
+	out := append([]byte(nil), data[:ihdrEnd]...)
+	out = append(out, pngChunk("eXIf", exifTIFF(orientation))...)
+	out = append(out, pngChunk("tEXt", []byte("Comment\x00"+secret))...)
+	return append(out, data[ihdrEnd:]...)
+}
+
+func pngChunk(kind string, body []byte) []byte {
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	out = append(out, kind...)
+	out = append(out, body...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[4:]))
+}
+
+// pngHeader returns a PNG signature and IHDR chunk claiming a w×h image, with no pixels.
+func pngHeader(w, h int) []byte {
+	ihdr := binary.BigEndian.AppendUint32(nil, uint32(w))
+	ihdr = binary.BigEndian.AppendUint32(ihdr, uint32(h))
+	ihdr = append(ihdr, 8, 6, 0, 0, 0)
+	return append(append([]byte(nil), pngSignature...), pngChunk("IHDR", ihdr)...)
+}
+
+// gifWithComment encodes a single-frame w×h GIF with a comment extension.
+func gifWithComment(t *testing.T, w, h int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	err := gif.Encode(&buf, testImage(w, h), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// Insert the comment before the trailer.
+	out := append([]byte(nil), data[:len(data)-1]...)
+	out = append(out, 0x21, 0xfe, byte(len(secret)))
+	out = append(out, secret...)
+	return append(out, 0x00, 0x3b)
+}
+
+// gifFrames returns a w×h GIF of n empty frames, which is enough for probeGIF.
+func gifFrames(w, h, n int) []byte {
+	out := []byte("GIF89a")
+	out = binary.LittleEndian.AppendUint16(out, uint16(w))
+	out = binary.LittleEndian.AppendUint16(out, uint16(h))
+	out = append(out, 0, 0, 0)
+	for i := 0; i < n; i++ {
+		out = append(out, 0x2c, 0, 0, 0, 0)
+		out = binary.LittleEndian.AppendUint16(out, uint16(w))
+		out = binary.LittleEndian.AppendUint16(out, uint16(h))
+		out = append(out, 0, 2, 0)
+	}
+	return append(out, 0x3b)
+}
+
+// bitWriter writes the least significant bit first, as VP8L does.
+type bitWriter struct {
+	buf  []byte
+	nbit uint
+}
+
+func (b *bitWriter) write(v uint32, n uint) {
+	for i := uint(0); i < n; i++ {
+		if b.nbit%8 == 0 {
+			b.buf = append(b.buf, 0)
+		}
+		b.buf[len(b.buf)-1] |= byte((v>>i)&1) << (b.nbit % 8)
+		b.nbit++
+	}
+}
+
+// vp8l returns a VP8L chunk holding a w×h image of a single colour: no transforms, and a
+// one-symbol prefix code for each of the green, red, blue, alpha and distance alphabets.
+func vp8l(w, h int) []byte {
+	var b bitWriter
+	b.write(0x2f, 8)
+	b.write(uint32(w-1), 14)
+	b.write(uint32(h-1), 14)
+	b.write(0, 1) // alpha hint
+	b.write(0, 3) // version
+	b.write(0, 1) // no transform
+	b.write(0, 1) // no colour cache
+	b.write(0, 1) // no meta prefix codes
+	for _, sym := range []uint32{200, 10, 20, 255, 0} {
+		b.write(1, 1) // simple code
+		b.write(0, 1) // one symbol
+		b.write(1, 1) // eight bits wide
+		b.write(sym, 8)
+	}
+	return riffChunk("VP8L", b.buf)
+}
+
+func riffChunk(kind string, body []byte) []byte {
+	out := []byte(kind)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(body)))
+	out = append(out, body...)
+	if len(body)%2 == 1 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+func riff(chunks ...[]byte) []byte {
+	body := []byte("WEBP")
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	out := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body)))
+	return append(out, body...)
+}
+
+func vp8x(flags byte, w, h int) []byte {
+	header := make([]byte, 10)
+	header[0] = flags
+	putUint24(header[4:], w-1)
+	putUint24(header[7:], h-1)
+	return riffChunk("VP8X", header)
+}
+
+// webpWithEXIF returns a still w×h WebP with EXIF and XMP chunks.
+func webpWithEXIF(w, h, orientation int) []byte {
+	return riff(
+		vp8x(webpFlagEXIF|webpFlagXMP, w, h),
+		vp8l(w, h),
+		riffChunk("EXIF", exifTIFF(orientation)),
+		riffChunk("XMP ", []byte("<x:xmpmeta>"+secret+"</x:xmpmeta>")),
+	)
+}
+
+// animWebP returns an animated WebP with a cw×ch canvas and the given ANMF chunks.
+func animWebP(cw, ch int, frames ...[]byte) []byte {
+	chunks := [][]byte{vp8x(webpFlagAnimation, cw, ch), riffChunk("ANIM", make([]byte, 6))}
+	return riff(append(chunks, frames...)...)
+}
+
+// anmf returns an ANMF chunk placing a w×h frame at x, y for 100ms.
+func anmf(x, y, w, h int, bitstream []byte) []byte {
+	header := make([]byte, 16)
+	putUint24(header[0:], x/2)
+	putUint24(header[3:], y/2)
+	putUint24(header[6:], w-1)
+	putUint24(header[9:], h-1)
+	putUint24(header[12:], 100)
+	return riffChunk("ANMF", append(header, bitstream...))
+}
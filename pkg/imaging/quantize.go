@@ -0,0 +1,294 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"sort"
+)
+
+// quantizer reduces frames to a palette of at most 256 colours by median cut over a
+// histogram of 15-bit colours. It is reused between frames to avoid reallocating its
+// tables.
+type quantizer struct {
+	counts [1 << 15]int
+	sums   [1 << 15][3]int
+	lut    [1 << 15]uint8
+}
+
+// colorKey packs the top five bits of each channel into a 15-bit histogram index.
+func colorKey(r, g, b uint8) int {
+	return int(r>>3)<<10 | int(g>>3)<<5 | int(b>>3)
+}
+
+// quantize returns img as a paletted image, with pixels under half opacity mapped to a
+// transparent palette entry. It reports whether there were any.
+func (q *quantizer) quantize(img image.Image) (*image.Paletted, bool) {
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = image.NewRGBA(img.Bounds())
+		draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	}
+
+	q.counts = [1 << 15]int{}
+	q.sums = [1 << 15][3]int{}
+
+	var (
+		keys        []int
+		transparent bool
+	)
+
+	b := src.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := src.Pix[src.PixOffset(b.Min.X, y):][:4*b.Dx()]
+		for i := 0; i < len(row); i += 4 {
+			r, g, bl, a := straight(row[i:])
+			if a < 0x80 {
+				transparent = true
+				continue
+			}
+
+			k := colorKey(r, g, bl)
+			if q.counts[k] == 0 {
+				keys = append(keys, k)
+			}
+			q.counts[k]++
+			q.sums[k][0] += int(r)
+			q.sums[k][1] += int(g)
+			q.sums[k][2] += int(bl)
+		}
+	}
+
+	maxColors := 256
+	if transparent {
+		maxColors--
+	}
+
+	var palette color.Palette
+	for _, box := range q.medianCut(keys, maxColors) {
+		var n, r, g, bl int
+		for _, k := range box {
+			n += q.counts[k]
+			r += q.sums[k][0]
+			g += q.sums[k][1]
+			bl += q.sums[k][2]
+			q.lut[k] = uint8(len(palette))
+		}
+		palette = append(palette, color.RGBA{uint8(r / n), uint8(g / n), uint8(bl / n), 0xff})
+	}
+
+	transparentIndex := uint8(len(palette))
+	if transparent {
+		palette = append(palette, color.RGBA{})
+	}
+
+	dst := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), palette)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := src.Pix[src.PixOffset(b.Min.X, y):][:4*b.Dx()]
+		out := dst.Pix[dst.PixOffset(0, y-b.Min.Y):]
+		for i := 0; i < len(row); i += 4 {
+			r, g, bl, a := straight(row[i:])
+			if a < 0x80 {
+				out[i/4] = transparentIndex
+				continue
+			}
+			out[i/4] = q.lut[colorKey(r, g, bl)]
+		}
+	}
+
+	return dst, transparent
+}
+
+// medianCut splits the histogram colours in keys into at most n boxes, each of which
+// becomes one palette entry. The box with the widest channel is split at its median
+// pixel until there are n boxes or none can be split further.
+func (q *quantizer) medianCut(keys []int, n int) [][]int {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	boxes := [][]int{keys}
+
+	for len(boxes) < n {
+		best, bestChannel, bestRange := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			channel, r := widestChannel(box)
+			if r > bestRange {
+				best, bestChannel, bestRange = i, channel, r
+			}
+		}
+		if best < 0 {
+			break
+		}
+
+		box := boxes[best]
+		shift := 10 - 5*bestChannel
+		sort.Slice(box, func(i, j int) bool {
+			return box[i]>>shift&0x1f < box[j]>>shift&0x1f
+		})
+
+		total := 0
+		for _, k := range box {
+			total += q.counts[k]
+		}
+		split, seen := 1, q.counts[box[0]]
+		for split < len(box)-1 && seen < total/2 {
+			seen += q.counts[box[split]]
+			split++
+		}
+
+		boxes[best] = box[:split]
+		boxes = append(boxes, box[split:])
+	}
+
+	return boxes
+}
+
+// widestChannel returns the channel (0 red, 1 green, 2 blue) with the largest range of
+// values in box, and that range.
+func widestChannel(box []int) (int, int) {
+	lo := [3]int{0x1f, 0x1f, 0x1f}
+	hi := [3]int{}
+	for _, k := range box {
+		for c := 0; c < 3; c++ {
+			v := k >> (10 - 5*c) & 0x1f
+			if v < lo[c] {
+				lo[c] = v
+			}
+			if v > hi[c] {
+				hi[c] = v
+			}
+		}
+	}
+
+	channel := 0
+	for c := 1; c < 3; c++ {
+		if hi[c]-lo[c] > hi[channel]-lo[channel] {
+			channel = c
+		}
+	}
+
+	return channel, hi[channel] - lo[channel]
+}
+
+// straight returns the non-premultiplied colour of an RGBA pixel.
+func straight(p []uint8) (uint8, uint8, uint8, uint8) {
+	a := p[3]
+	if a == 0xff || a == 0 {
+		return p[0], p[1], p[2], a
+	}
+	return uint8(int(p[0]) * 0xff / int(a)),
+		uint8(int(p[1]) * 0xff / int(a)),
+		uint8(int(p[2]) * 0xff / int(a)),
+		a
+}
+
+// gifEncoder collects the frames of an animated GIF as they are rendered.
+type gifEncoder struct {
+	q           quantizer
+	frames      []*image.Paletted
+	delays      []int
+	transparent bool
+}
+
+// add quantizes one frame and appends it, with its delay in milliseconds.
+func (e *gifEncoder) add(img image.Image, delayMS int) {
+	frame, transparent := e.q.quantize(img)
+	e.frames = append(e.frames, frame)
+	e.delays = append(e.delays, (delayMS+5)/10)
+	e.transparent = e.transparent || transparent
+}
+
+// encode writes the collected frames as a GIF with the given loop count (0 for forever,
+// otherwise the number of plays).
+//
+// Fully opaque animations are stored as the changes between frames: each frame after the
+// first is cropped to the pixels that differ from the one before, and unchanged frames
+// are merged into the previous delay. Captions and other static areas are then only
+// stored once. Animations with transparency keep whole frames, each cleared before the
+// next is drawn.
+func (e *gifEncoder) encode(loopCount int) ([]byte, error) {
+	g := gif.GIF{
+		Config: image.Config{
+			Width:  e.frames[0].Bounds().Dx(),
+			Height: e.frames[0].Bounds().Dy(),
+		},
+	}
+
+	// A GIF's loop count is the number of repeats, with 0 for forever and -1 for none.
+	switch {
+	case loopCount == 1:
+		g.LoopCount = -1
+	case loopCount > 1:
+		g.LoopCount = loopCount - 1
+	}
+
+	for i, frame := range e.frames {
+		if e.transparent || i == 0 {
+			g.Image = append(g.Image, frame)
+			g.Delay = append(g.Delay, e.delays[i])
+			g.Disposal = append(g.Disposal, disposal(e.transparent))
+			continue
+		}
+
+		changed := diffRect(e.frames[i-1], frame)
+		if changed.Empty() {
+			g.Delay[len(g.Delay)-1] += e.delays[i]
+			continue
+		}
+
+		g.Image = append(g.Image, frame.SubImage(changed).(*image.Paletted))
+		g.Delay = append(g.Delay, e.delays[i])
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+	}
+
+	var buf bytes.Buffer
+
+	err := gif.EncodeAll(&buf, &g)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// disposal is the GIF disposal method for frames of an animation with or without
+// transparency.
+func disposal(transparent bool) byte {
+	if transparent {
+		return gif.DisposalBackground
+	}
+	return gif.DisposalNone
+}
+
+// diffRect returns the smallest rectangle holding every pixel whose colour differs
+// between two frames of the same size.
+func diffRect(a, b *image.Paletted) image.Rectangle {
+	pa, pb := rgbaPalette(a.Palette), rgbaPalette(b.Palette)
+
+	var r image.Rectangle
+	bounds := b.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if pa[a.ColorIndexAt(x, y)] != pb[b.ColorIndexAt(x, y)] {
+				r = r.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+
+	return r
+}
+
+// rgbaPalette converts a palette to comparable colour values.
+func rgbaPalette(p color.Palette) []color.RGBA {
+	out := make([]color.RGBA, len(p))
+	for i, c := range p {
+		out[i] = color.RGBAModel.Convert(c).(color.RGBA)
+	}
+	return out
+}
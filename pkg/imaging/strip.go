@@ -0,0 +1,355 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+)
+
+// orientedJPEGQuality is used when a JPEG has to be re-encoded to bake in its EXIF
+// orientation. It is higher than jpegQuality since the result replaces the original.
+const orientedJPEGQuality = 92
+
+var errUnsupported = errors.New("imaging: unsupported image format")
+
+// StripMetadata returns a copy of a JPEG, PNG, GIF or WebP image with EXIF, XMP, IPTC,
+// comments and text chunks removed, so that GPS positions, device serial numbers and the
+// like are not published. Colour profiles and animation data are kept.
+//
+// Images are rewritten at the container level and not re-encoded, except for JPEGs with
+// an EXIF orientation: those are rotated upright and re-encoded, since dropping the EXIF
+// block would otherwise show them sideways. Other formats keep their pixels as they are.
+func StripMetadata(data []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		if o := StrippedOrientation(data); o > 1 {
+			return reorientJPEG(data, o)
+		}
+		return stripJPEG(data)
+	case isPNG(data):
+		return stripPNG(data)
+	case isWebP(data):
+		return stripWebP(data)
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return stripGIF(data)
+	default:
+		return nil, errUnsupported
+	}
+}
+
+// StrippedOrientation returns the EXIF orientation that StripMetadata bakes into its copy
+// of data, to be passed to Orient, or 1 if the copy keeps the pixels as they are.
+func StrippedOrientation(data []byte) int {
+	if !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return 1
+	}
+	if o := ReadMetadata(data).Orientation; o > 1 && o <= 8 {
+		return o
+	}
+	return 1
+}
+
+// stripJPEG drops every APPn segment except JFIF (APP0), ICC profiles (APP2) and Adobe
+// colour transforms (APP14), along with COM segments. Scans are copied unchanged, and
+// anything after the end-of-image marker, such as MPF secondary images with EXIF blocks of
+// their own, is dropped.
+func stripJPEG(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	for pos := 2; pos < len(data); {
+		if data[pos] != 0xff {
+			return nil, errors.New("imaging: invalid JPEG marker")
+		}
+
+		// Skip fill bytes.
+		start := pos
+		for pos < len(data) && data[pos] == 0xff {
+			pos++
+		}
+		if pos >= len(data) {
+			return nil, errTruncated
+		}
+		marker := data[pos]
+		pos++
+
+		// Markers without a length.
+		if marker == 0xd8 || marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			out.Write(data[start:pos])
+			continue
+		}
+		if marker == 0xd9 {
+			out.Write(data[start:pos])
+			break
+		}
+
+		if pos+2 > len(data) {
+			return nil, errTruncated
+		}
+		end := pos + int(binary.BigEndian.Uint16(data[pos:]))
+		if end < pos+2 {
+			return nil, errors.New("imaging: invalid JPEG segment length")
+		}
+		if end > len(data) {
+			return nil, errTruncated
+		}
+
+		if marker == 0xda {
+			pos = jpegScanEnd(data, end)
+			out.Write(data[start:pos])
+			continue
+		}
+
+		if keepJPEGSegment(marker, data[pos+2:end]) {
+			out.Write(data[start:end])
+		}
+		pos = end
+	}
+
+	return out.Bytes(), nil
+}
+
+// jpegScanEnd returns the position of the marker that ends the entropy-coded data of a
+// scan starting at pos, skipping stuffed zero bytes and restart markers, or len(data) if
+// the scan is truncated.
+func jpegScanEnd(data []byte, pos int) int {
+	for ; pos+1 < len(data); pos++ {
+		if data[pos] != 0xff {
+			continue
+		}
+		if m := data[pos+1]; m != 0x00 && (m < 0xd0 || m > 0xd7) {
+			return pos
+		}
+		pos++
+	}
+	return len(data)
+}
+
+// keepJPEGSegment reports whether a segment carries image data rather than metadata.
+func keepJPEGSegment(marker byte, body []byte) bool {
+	switch {
+	case marker == 0xe0:
+		return bytes.HasPrefix(body, []byte("JFIF\x00")) ||
+			bytes.HasPrefix(body, []byte("JFXX\x00"))
+	case marker == 0xe2:
+		return bytes.HasPrefix(body, []byte("ICC_PROFILE\x00"))
+	case marker == 0xee:
+		return bytes.HasPrefix(body, []byte("Adobe"))
+	case marker >= 0xe0 && marker <= 0xef, marker == 0xfe:
+		return false
+	default:
+		return true
+	}
+}
+
+// reorientJPEG decodes a JPEG, rotates or flips it upright according to its EXIF
+// orientation and re-encodes it, which drops all of its metadata.
+func reorientJPEG(data []byte, orientation int) ([]byte, error) {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, Orient(img, orientation), &jpeg.Options{Quality: orientedJPEGQuality})
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Orient applies an EXIF orientation (1 to 8) to img, returning it the right way up.
+func Orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		// Orientations 5 to 8 swap the axes.
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], src.Pix[src.PixOffset(x, y):][:4])
+		}
+	}
+
+	return dst
+}
+
+// stripPNG drops the eXIf chunk, the tEXt, zTXt and iTXt text chunks (which hold XMP and
+// free-form comments) and the tIME chunk.
+func stripPNG(data []byte) ([]byte, error) {
+	chunks, err := pngChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(pngSignature)
+
+	for _, c := range chunks {
+		switch c.kind {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+			continue
+		}
+		out.Write(data[c.start:c.end])
+	}
+
+	return out.Bytes(), nil
+}
+
+// WebP VP8X header flags for the metadata chunks.
+const (
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+// stripWebP drops the EXIF and XMP chunks, clears their flags in the VP8X header and fixes
+// up the RIFF length.
+func stripWebP(data []byte) ([]byte, error) {
+	chunks, err := riffChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+
+	for _, c := range chunks {
+		switch c.kind {
+		case "EXIF", "XMP ":
+			continue
+		case "VP8X":
+			vp8x := append([]byte(nil), data[c.start:c.end]...)
+			if len(vp8x) > 8 {
+				vp8x[8] &^= webpFlagEXIF | webpFlagXMP
+			}
+			out.Write(vp8x)
+		default:
+			out.Write(data[c.start:c.end])
+		}
+	}
+
+	stripped := out.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:], uint32(len(stripped)-8))
+
+	return stripped, nil
+}
+
+// stripGIF drops comment extensions and application extensions other than the
+// NETSCAPE2.0/ANIMEXTS1.0 looping extension, which is where GIFs carry XMP.
+func stripGIF(data []byte) ([]byte, error) {
+	if len(data) < 13 {
+		return nil, errTruncated
+	}
+
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 << (data[10]&0x07 + 1)
+	}
+	if pos > len(data) {
+		return nil, errTruncated
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:pos])
+
+	for pos < len(data) {
+		start := pos
+
+		switch data[pos] {
+		case 0x3b: // trailer
+			out.Write(data[pos : pos+1])
+			return out.Bytes(), nil
+		case 0x21: // extension
+			if pos+2 > len(data) {
+				return nil, errTruncated
+			}
+			label := data[pos+1]
+			end, err := gifSubBlocksEnd(data, pos+2)
+			if err != nil {
+				return nil, err
+			}
+			pos = end
+
+			if label == 0xfe {
+				continue
+			}
+			if label == 0xff {
+				id := data[start+2 : end]
+				if len(id) < 12 ||
+					!(bytes.Equal(id[1:12], []byte("NETSCAPE2.0")) ||
+						bytes.Equal(id[1:12], []byte("ANIMEXTS1.0"))) {
+					continue
+				}
+			}
+			out.Write(data[start:end])
+		case 0x2c: // image descriptor
+			if pos+10 > len(data) {
+				return nil, errTruncated
+			}
+			packed := data[pos+9]
+			pos += 10
+			if packed&0x80 != 0 {
+				pos += 3 << (packed&0x07 + 1)
+			}
+			// Skip the LZW minimum code size, then the image data sub-blocks.
+			end, err := gifSubBlocksEnd(data, pos+1)
+			if err != nil {
+				return nil, err
+			}
+			pos = end
+			out.Write(data[start:end])
+		default:
+			return nil, errors.New("imaging: invalid GIF block")
+		}
+	}
+
+	return nil, errTruncated
+}
+
+// gifSubBlocksEnd returns the position just after the run of GIF data sub-blocks starting
+// at pos, including its zero-length terminator.
+func gifSubBlocksEnd(data []byte, pos int) (int, error) {
+	for {
+		if pos >= len(data) {
+			return 0, errTruncated
+		}
+		n := int(data[pos])
+		pos++
+		if n == 0 {
+			return pos, nil
+		}
+		pos += n
+	}
+}
@@ -0,0 +1,210 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+func TestStripMetadataRemovesMetadata(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		format string
+	}{
+		{"jpeg", jpegWithEXIF(t, 8, 6, 1), "jpeg"},
+		{"jpeg rotated", jpegWithEXIF(t, 8, 6, 6), "jpeg"},
+		{"png", pngWithEXIF(t, 8, 6, 1), "png"},
+		{"webp", webpWithEXIF(8, 6, 1), "webp"},
+		{"gif", gifWithComment(t, 8, 6), "gif"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !bytes.Contains(tt.data, []byte(secret)) {
+				t.Fatal("fixture has no metadata to strip")
+			}
+
+			stripped, err := StripMetadata(tt.data)
+			if err != nil {
+				t.Fatalf("StripMetadata: %v", err)
+			}
+
+			if bytes.Contains(stripped, []byte(secret)) {
+				t.Error("stripped image still contains its metadata")
+			}
+			if md := ReadMetadata(stripped); md.Orientation != 0 {
+				t.Errorf("stripped image has orientation %d, want none", md.Orientation)
+			}
+
+			_, format, err := image.DecodeConfig(bytes.NewReader(stripped))
+			if err != nil {
+				t.Fatalf("stripped image does not decode: %v", err)
+			}
+			if format != tt.format {
+				t.Errorf("stripped image is %s, want %s", format, tt.format)
+			}
+		})
+	}
+}
+
+func TestStripMetadataWebPFlags(t *testing.T) {
+	stripped, err := StripMetadata(webpWithEXIF(8, 6, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := riffChunks(stripped)
+	if err != nil {
+		t.Fatalf("stripped WebP does not parse: %v", err)
+	}
+	for _, c := range chunks {
+		if c.kind == "VP8X" && c.body[0]&(webpFlagEXIF|webpFlagXMP) != 0 {
+			t.Errorf("VP8X flags %#x still announce metadata", c.body[0])
+		}
+	}
+}
+
+func TestStripMetadataMalformed(t *testing.T) {
+	jpegData := jpegWithEXIF(t, 8, 6, 1)
+
+	// A segment whose length field is shorter than the field itself.
+	shortSegment := append([]byte{0xff, 0xd8}, 0xff, 0xe1, 0x00, 0x01)
+	shortSegment = append(shortSegment, jpegData[2:]...)
+
+	pngData := pngWithEXIF(t, 8, 6, 1)
+
+	// A chunk claiming more bytes than the file holds.
+	longChunk := append([]byte(nil), pngData...)
+	longChunk[len(pngSignature)+3] = 0xff
+
+	webpData := webpWithEXIF(8, 6, 1)
+	gifData := gifWithComment(t, 8, 6)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"unknown format", []byte("not an image")},
+		{"jpeg bad marker", []byte{0xff, 0xd8, 0x00, 0x00}},
+		{"jpeg fill bytes only", []byte{0xff, 0xd8, 0xff, 0xff}},
+		{"jpeg cut in length", jpegData[:5]},
+		{"jpeg cut in segment", jpegData[:20]},
+		{"jpeg short segment", shortSegment},
+		{"png cut in chunk", pngData[:len(pngSignature)+10]},
+		{"png chunk too long", longChunk},
+		{"webp cut in chunk", webpData[:len(webpData)-3]},
+		{"gif cut in header", gifData[:10]},
+		{"gif without trailer", gifData[:len(gifData)-1]},
+		{"gif bad block", append(append([]byte(nil), gifData[:len(gifData)-1]...), 0x42)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := StripMetadata(tt.data)
+			if err == nil {
+				t.Error("StripMetadata accepted a malformed image")
+			}
+		})
+	}
+}
+
+func TestTruncatedImagesDoNotPanic(t *testing.T) {
+	fixtures := map[string][]byte{
+		"jpeg":     jpegWithEXIF(t, 8, 6, 1),
+		"png":      pngWithEXIF(t, 8, 6, 6),
+		"webp":     webpWithEXIF(8, 6, 6),
+		"gif":      gifWithComment(t, 8, 6),
+		"animated": animWebP(8, 8, anmf(0, 0, 8, 8, vp8l(8, 8)), anmf(2, 2, 4, 4, vp8l(4, 4))),
+	}
+
+	for name, data := range fixtures {
+		for n := 0; n < len(data); n++ {
+			truncated := data[:n]
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("%s cut to %d bytes: panic: %v", name, n, r)
+					}
+				}()
+
+				_, _ = StripMetadata(truncated)
+				_ = ReadMetadata(truncated)
+				if _, err := Probe(truncated); err == nil {
+					_, _, _ = Decode(truncated)
+				}
+			}()
+		}
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// Where the top-left pixel of a 3×2 image ends up, and the size of the result.
+	tests := []struct {
+		orientation int
+		size        image.Point
+		topLeft     image.Point
+	}{
+		{0, image.Pt(3, 2), image.Pt(0, 0)},
+		{1, image.Pt(3, 2), image.Pt(0, 0)},
+		{2, image.Pt(3, 2), image.Pt(2, 0)},
+		{3, image.Pt(3, 2), image.Pt(2, 1)},
+		{4, image.Pt(3, 2), image.Pt(0, 1)},
+		{5, image.Pt(2, 3), image.Pt(0, 0)},
+		{6, image.Pt(2, 3), image.Pt(1, 0)},
+		{7, image.Pt(2, 3), image.Pt(1, 2)},
+		{8, image.Pt(2, 3), image.Pt(0, 2)},
+		{9, image.Pt(3, 2), image.Pt(0, 0)},
+	}
+
+	src := testImage(3, 2)
+
+	for _, tt := range tests {
+		got := Orient(src, tt.orientation)
+		if size := got.Bounds().Size(); size != tt.size {
+			t.Errorf("orientation %d: size %v, want %v", tt.orientation, size, tt.size)
+			continue
+		}
+		if got.At(tt.topLeft.X, tt.topLeft.Y) != src.At(0, 0) {
+			t.Errorf("orientation %d: top-left pixel is not at %v", tt.orientation, tt.topLeft)
+		}
+	}
+}
+
+func TestStrippedOrientation(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        []byte
+		orientation int
+		size        image.Point
+	}{
+		{"jpeg upright", jpegWithEXIF(t, 8, 6, 1), 1, image.Pt(8, 6)},
+		{"jpeg mirrored", jpegWithEXIF(t, 8, 6, 2), 2, image.Pt(8, 6)},
+		{"jpeg rotated", jpegWithEXIF(t, 8, 6, 6), 6, image.Pt(6, 8)},
+		{"jpeg bad orientation", jpegWithEXIF(t, 8, 6, 9), 1, image.Pt(8, 6)},
+		// Only JPEGs are rotated, so other formats keep their size.
+		{"png rotated", pngWithEXIF(t, 8, 6, 6), 1, image.Pt(8, 6)},
+		{"webp rotated", webpWithEXIF(8, 6, 6), 1, image.Pt(8, 6)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StrippedOrientation(tt.data); got != tt.orientation {
+				t.Errorf("StrippedOrientation = %d, want %d", got, tt.orientation)
+			}
+
+			stripped, err := StripMetadata(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(stripped))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := image.Pt(cfg.Width, cfg.Height); size != tt.size {
+				t.Errorf("stripped image is %v, want %v", size, tt.size)
+			}
+		})
+	}
+}
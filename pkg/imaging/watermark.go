@@ -0,0 +1,163 @@
+package imaging
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+)
+
+// Watermark positions.
+const (
+	WatermarkTopLeft     = "top-left"
+	WatermarkTopRight    = "top-right"
+	WatermarkBottomLeft  = "bottom-left"
+	WatermarkBottomRight = "bottom-right"
+	WatermarkCenter      = "center"
+)
+
+// watermarkFontSize is the size, in pixels, that text watermarks are rendered at before
+// being scaled to fit each image.
+const watermarkFontSize = 64
+
+// Watermark is an image, such as a logo or rendered text, drawn over images for
+// attribution. Scale is the fraction of the image's width that the watermark spans, and
+// Opacity how opaque it is drawn, from 0 to 1. It is inset from the edges of the image
+// by a small margin, except at WatermarkCenter.
+type Watermark struct {
+	Image    image.Image
+	Position string
+	Opacity  float64
+	Scale    float64
+}
+
+// TextWatermark renders text as a watermark image: white, outlined in black so that it
+// stays legible on any background.
+func TextWatermark(text string) (*image.RGBA, error) {
+	f, err := loadCaptionFont()
+	if err != nil {
+		return nil, err
+	}
+
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{
+		Size:    watermarkFontSize,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	const stroke = 3
+	text = strings.Join(strings.Fields(text), " ")
+	width := font.MeasureString(face, text).Ceil() + 2*stroke
+	height := face.Metrics().Height.Ceil() + 2*stroke
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	err = renderCaption(img, f, Caption{
+		Text:        text,
+		Box:         img.Bounds(),
+		FontSize:    watermarkFontSize,
+		Align:       "center",
+		Color:       color.White,
+		StrokeColor: color.Black,
+		StrokeWidth: stroke,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return img, nil
+}
+
+// Validate checks the watermark's position, opacity and scale.
+func (w *Watermark) Validate() error {
+	switch w.Position {
+	case WatermarkTopLeft, WatermarkTopRight, WatermarkBottomLeft, WatermarkBottomRight,
+		WatermarkCenter:
+	default:
+		return fmt.Errorf("unknown watermark position %q", w.Position)
+	}
+
+	if math.IsNaN(w.Opacity) || w.Opacity < 0 || w.Opacity > 1 {
+		return errors.New("watermark opacity must be between 0 and 1")
+	}
+
+	if math.IsNaN(w.Scale) || w.Scale <= 0 || w.Scale > 1 {
+		return errors.New("watermark scale must be greater than 0 and at most 1")
+	}
+
+	return nil
+}
+
+// Apply returns a copy of img with the watermark drawn over it, scaled to the image's
+// width.
+func (w *Watermark) Apply(img image.Image) *image.RGBA {
+	b := img.Bounds()
+
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(out, out.Bounds(), img, b.Min, draw.Src)
+
+	width := int(float64(b.Dx())*w.Scale + 0.5)
+	if width < 1 {
+		return out
+	}
+	mark := Resize(w.Image, width)
+	size := mark.Bounds().Size()
+
+	margin := b.Dx() / 50
+	var at image.Point
+	switch w.Position {
+	case WatermarkTopLeft:
+		at = image.Pt(margin, margin)
+	case WatermarkTopRight:
+		at = image.Pt(b.Dx()-size.X-margin, margin)
+	case WatermarkBottomLeft:
+		at = image.Pt(margin, b.Dy()-size.Y-margin)
+	case WatermarkCenter:
+		at = image.Pt((b.Dx()-size.X)/2, (b.Dy()-size.Y)/2)
+	default:
+		at = image.Pt(b.Dx()-size.X-margin, b.Dy()-size.Y-margin)
+	}
+
+	mask := image.NewUniform(color.Alpha{uint8(w.Opacity*0xff + 0.5)})
+	draw.DrawMask(
+		out,
+		image.Rectangle{Min: at, Max: at.Add(size)},
+		mark,
+		mark.Bounds().Min,
+		mask,
+		image.Point{},
+		draw.Over,
+	)
+
+	return out
+}
+
+// Fingerprint returns a short hex digest of the watermark's image and settings. Images
+// watermarked differently are stored under keys that include it, so that changing the
+// watermark never serves stale copies from caches.
+func (w *Watermark) Fingerprint() string {
+	h := sha256.New()
+
+	b := w.Image.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), w.Image, b.Min, draw.Src)
+
+	_ = binary.Write(h, binary.BigEndian, [2]int64{int64(b.Dx()), int64(b.Dy())})
+	h.Write(rgba.Pix)
+	fmt.Fprintf(h, "\n%s\n%g\n%g", w.Position, w.Opacity, w.Scale)
+
+	return hex.EncodeToString(h.Sum(nil)[:4])
+}
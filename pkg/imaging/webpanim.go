@@ -0,0 +1,161 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+
+	"golang.org/x/image/webp"
+)
+
+// WebP VP8X header flags used to read and rebuild animation frames.
+const (
+	webpFlagAnimation = 0x02
+	webpFlagAlpha     = 0x10
+)
+
+// webpFrame is one ANMF frame of an animated WebP.
+type webpFrame struct {
+	rect    image.Rectangle
+	delayMS int
+	blend   bool
+	dispose bool
+	data    []byte
+}
+
+// webpAnimation is the canvas size, loop count and frames of an animated WebP. A loop
+// count of 0 means forever.
+type webpAnimation struct {
+	width     int
+	height    int
+	loopCount int
+	frames    []webpFrame
+}
+
+// isAnimatedWebP reports whether data is a WebP with the animation flag set in its VP8X
+// header. golang.org/x/image/webp cannot decode these, so they are read frame by frame.
+func isAnimatedWebP(data []byte) bool {
+	return isWebP(data) && len(data) > 20 && string(data[12:16]) == "VP8X" &&
+		data[20]&webpFlagAnimation != 0
+}
+
+// parseWebPAnimation reads the VP8X, ANIM and ANMF chunks of an animated WebP without
+// decoding any frames.
+func parseWebPAnimation(data []byte) (*webpAnimation, error) {
+	chunks, err := riffChunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var anim webpAnimation
+
+	for _, c := range chunks {
+		switch c.kind {
+		case "VP8X":
+			if len(c.body) < 10 {
+				return nil, errTruncated
+			}
+			anim.width = uint24(c.body[4:]) + 1
+			anim.height = uint24(c.body[7:]) + 1
+		case "ANIM":
+			if len(c.body) < 6 {
+				return nil, errTruncated
+			}
+			anim.loopCount = int(binary.LittleEndian.Uint16(c.body[4:]))
+		case "ANMF":
+			if len(c.body) < 16 {
+				return nil, errTruncated
+			}
+			x, y := 2*uint24(c.body[0:]), 2*uint24(c.body[3:])
+			anim.frames = append(anim.frames, webpFrame{
+				rect:    image.Rect(x, y, x+uint24(c.body[6:])+1, y+uint24(c.body[9:])+1),
+				delayMS: uint24(c.body[12:]),
+				blend:   c.body[15]&0x02 == 0,
+				dispose: c.body[15]&0x01 != 0,
+				data:    c.body[16:],
+			})
+		}
+	}
+
+	if anim.width == 0 || len(anim.frames) == 0 {
+		return nil, errors.New("imaging: WebP animation has no frames")
+	}
+
+	// Frames are decoded at their own size, so they must fit the canvas, whose size Probe
+	// checks.
+	canvas := image.Rect(0, 0, anim.width, anim.height)
+	for _, f := range anim.frames {
+		if !f.rect.In(canvas) {
+			return nil, errors.New("imaging: WebP animation frame is outside the canvas")
+		}
+	}
+
+	return &anim, nil
+}
+
+// decodeWebPFrame decodes one animation frame by wrapping its ALPH and VP8/VP8L chunks in
+// a still WebP container. The size of the bitstream is checked against the frame first,
+// so that a frame cannot decode to more pixels than it covers.
+func decodeWebPFrame(f webpFrame) (image.Image, error) {
+	chunks, err := riffChunksFrom(f.data, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var vp8x, alpha, bitstream []byte
+
+	for _, c := range chunks {
+		switch c.kind {
+		case "ALPH":
+			// Alpha only applies to lossy frames, and needs a VP8X header to be read.
+			vp8x = make([]byte, 18)
+			copy(vp8x, "VP8X")
+			vp8x[4] = 10
+			vp8x[8] = webpFlagAlpha
+			putUint24(vp8x[12:], f.rect.Dx()-1)
+			putUint24(vp8x[15:], f.rect.Dy()-1)
+			alpha = f.data[c.start:c.end]
+		case "VP8 ", "VP8L":
+			bitstream = f.data[c.start:c.end]
+		}
+	}
+	if bitstream == nil {
+		return nil, errors.New("imaging: WebP animation frame has no image data")
+	}
+
+	cfg, err := webp.DecodeConfig(bytes.NewReader(webpStill(bitstream)))
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width != f.rect.Dx() || cfg.Height != f.rect.Dy() {
+		return nil, errors.New("imaging: WebP animation frame size does not match its data")
+	}
+
+	return webp.Decode(bytes.NewReader(webpStill(vp8x, alpha, bitstream)))
+}
+
+// webpStill wraps chunks in a RIFF WebP container.
+func webpStill(chunks ...[]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("RIFF\x00\x00\x00\x00WEBP")
+
+	for _, c := range chunks {
+		buf.Write(c)
+	}
+
+	still := buf.Bytes()
+	binary.LittleEndian.PutUint32(still[4:], uint32(len(still)-8))
+
+	return still
+}
+
+// uint24 reads a little-endian 24-bit integer.
+func uint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+// putUint24 writes a little-endian 24-bit integer.
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidBBox = errors.New("bbox must be minLon,minLat,maxLon,maxLat")
+
+// BBox is a map viewport, in WGS84 degrees. A box whose MinLon is greater than its MaxLon
+// crosses the antimeridian, and covers MinLon..180 together with -180..MaxLon.
+type BBox struct {
+	MinLon float64
+	MinLat float64
+	MaxLon float64
+	MaxLat float64
+}
+
+// ParseBBox parses a bbox query parameter of the form minLon,minLat,maxLon,maxLat.
+func ParseBBox(s string) (BBox, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return BBox{}, ErrInvalidBBox
+	}
+
+	var values [4]float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return BBox{}, ErrInvalidBBox
+		}
+		values[i] = v
+	}
+
+	box := BBox{MinLon: values[0], MinLat: values[1], MaxLon: values[2], MaxLat: values[3]}
+
+	if err := ValidateCoordinates(box.MinLat, box.MinLon); err != nil {
+		return BBox{}, err
+	}
+	if err := ValidateCoordinates(box.MaxLat, box.MaxLon); err != nil {
+		return BBox{}, err
+	}
+	if box.MinLat > box.MaxLat {
+		return BBox{}, errors.New("bbox minLat must not be greater than maxLat")
+	}
+
+	return box, nil
+}
+
+// CrossesAntimeridian reports whether the box wraps around from 180 to -180 longitude.
+func (b BBox) CrossesAntimeridian() bool {
+	return b.MinLon > b.MaxLon
+}
@@ -0,0 +1,9 @@
+package models
+
+// MemeCluster is a group of memes that fall in the same grid cell at some map zoom level.
+type MemeCluster struct {
+	Count    int     `json:"count"`
+	Lan      float64 `json:"lat"`
+	Lon      float64 `json:"lon"`
+	SampleID int     `json:"sample_id"`
+}
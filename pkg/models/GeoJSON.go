@@ -0,0 +1,56 @@
+package models
+
+// Locatable is anything that can be rendered as a GeoJSON Point feature.
+type Locatable interface {
+	FeatureID() int
+	Location() (lat, lon float64)
+}
+
+// Point is a GeoJSON Point geometry. Coordinates are [lon, lat], as RFC 7946 requires.
+type Point struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// Feature is a GeoJSON Feature whose properties are the located value itself, so it keeps
+// the same fields as the plain JSON representation.
+type Feature struct {
+	Type       string      `json:"type"`
+	ID         int         `json:"id"`
+	Geometry   Point       `json:"geometry"`
+	Properties interface{} `json:"properties"`
+}
+
+// FeatureCollection is a GeoJSON FeatureCollection.
+type FeatureCollection struct {
+	Type     string    `json:"type"`
+	Features []Feature `json:"features"`
+}
+
+// NewFeature returns v as a GeoJSON Point feature.
+func NewFeature(v Locatable) Feature {
+	lat, lon := v.Location()
+
+	return Feature{
+		Type: "Feature",
+		ID:   v.FeatureID(),
+		Geometry: Point{
+			Type:        "Point",
+			Coordinates: [2]float64{lon, lat},
+		},
+		Properties: v,
+	}
+}
+
+// NewFeatureCollection returns items as a GeoJSON FeatureCollection.
+func NewFeatureCollection[T Locatable](items []T) FeatureCollection {
+	features := make([]Feature, 0, len(items))
+	for _, item := range items {
+		features = append(features, NewFeature(item))
+	}
+
+	return FeatureCollection{
+		Type:     "FeatureCollection",
+		Features: features,
+	}
+}
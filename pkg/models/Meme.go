@@ -1,12 +1,187 @@
 package models
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
 
+// Length limits, in characters, of the text that describes a meme.
+const (
+	MaxTitleLength   = 255
+	MaxCaptionLength = 2000
+)
+
+var (
+	ErrInvalidLatitude   = errors.New("lat must be a number between -90 and 90")
+	ErrInvalidLongitude  = errors.New("lon must be a number between -180 and 180")
+	ErrInvalidVisibility = errors.New("visibility must be public, private or pending")
+	ErrTitleTooLong      = fmt.Errorf("title must be at most %d characters", MaxTitleLength)
+	ErrCaptionTooLong    = fmt.Errorf(
+		"caption and alt_text must be at most %d characters",
+		MaxCaptionLength,
+	)
+)
+
+// Meme visibilities. Only public memes are listed and have openly served images; private
+// and pending (awaiting moderation) memes are only shown to authenticated users, with
+// signed image URLs.
+const (
+	VisibilityPublic  = "public"
+	VisibilityPrivate = "private"
+	VisibilityPending = "pending"
+)
+
+// Meme is a geotagged meme image. Variants maps a width in pixels, as a string, to the
+// path of the image resized to that width. CapturedAt is when the photo was originally
+// taken, if its EXIF data said so. PHash is the perceptual hash of uploaded images, and
+// DuplicateOf points at an earlier meme that looked the same when this one was uploaded.
+//
+// MediaType, Width and Height describe the stored image, and FrameCount and DurationMS
+// its animation: a still has one frame and no duration. Memes stored before these were
+// recorded have no media type or size.
+//
+// Visibility is one of VisibilityPublic, VisibilityPrivate or VisibilityPending; empty
+// means public. BlurHash is a compact blurred preview of the image (https://blurha.sh)
+// that clients can draw while it loads. Watermark says whether the configured watermark
+// is drawn on the meme's image and variants; nil means the default, which is yes. Once a
+// watermarked copy of the image has been generated, Image is its path and SourceImage the
+// path of the stored image without the watermark, which is never sent to clients.
+//
+// Title and Caption describe the meme, and AltText describes its image for screen
+// readers. Tags are normalised tag names, as returned by NormalizeTags.
+//
+// OwnerID is the user who created the meme. Memes created before ownership was recorded,
+// or whose owner has been deleted, have none.
 type Meme struct {
-	ID        int       `json:"id"`
-	Lan       string    `json:"lat"`
-	Lon       string    `json:"lon"`
-	Image     string    `json:"image"`
-	CreatedAt time.Time `json:"-"`
-	UpdatedAt time.Time `json:"-"`
+	ID          int               `json:"id"`
+	Lan         float64           `json:"lat"`
+	Lon         float64           `json:"lon"`
+	Image       string            `json:"image"`
+	SourceImage string            `json:"-"`
+	Variants    map[string]string `json:"variants"`
+	CapturedAt  *time.Time        `json:"captured_at,omitempty"`
+	PHash       *int64            `json:"-"`
+	DuplicateOf *int              `json:"duplicate_of,omitempty"`
+	MediaType   string            `json:"media_type,omitempty"`
+	Width       int               `json:"width,omitempty"`
+	Height      int               `json:"height,omitempty"`
+	FrameCount  int               `json:"frame_count"`
+	DurationMS  int               `json:"duration_ms"`
+	Visibility  string            `json:"visibility"`
+	BlurHash    string            `json:"blurhash,omitempty"`
+	Watermark   *bool             `json:"watermark,omitempty"`
+	Title       string            `json:"title"`
+	Caption     string            `json:"caption"`
+	AltText     string            `json:"alt_text"`
+	Tags        []string          `json:"tags"`
+	OwnerID     *int              `json:"owner_id,omitempty"`
+	CreatedAt   time.Time         `json:"-"`
+	UpdatedAt   time.Time         `json:"-"`
+}
+
+// Validate checks that the meme's coordinates are in range, its visibility is known and
+// its text is not too long.
+func (m *Meme) Validate() error {
+	switch m.Visibility {
+	case "", VisibilityPublic, VisibilityPrivate, VisibilityPending:
+	default:
+		return ErrInvalidVisibility
+	}
+
+	if utf8.RuneCountInString(m.Title) > MaxTitleLength {
+		return ErrTitleTooLong
+	}
+	if utf8.RuneCountInString(m.Caption) > MaxCaptionLength ||
+		utf8.RuneCountInString(m.AltText) > MaxCaptionLength {
+		return ErrCaptionTooLong
+	}
+
+	return ValidateCoordinates(m.Lan, m.Lon)
+}
+
+// IsPublic reports whether the meme may be listed and its image served to anyone.
+func (m *Meme) IsPublic() bool {
+	return m.Visibility == "" || m.Visibility == VisibilityPublic
+}
+
+// Watermarked reports whether the meme's image and variants should carry the watermark.
+func (m *Meme) Watermarked() bool {
+	return m.Watermark == nil || *m.Watermark
+}
+
+// OwnedBy reports whether the meme belongs to the user with the given ID.
+func (m *Meme) OwnedBy(userID int) bool {
+	return m.OwnerID != nil && *m.OwnerID == userID
+}
+
+// FeatureID returns the meme's ID, for use as a GeoJSON feature id.
+func (m *Meme) FeatureID() int {
+	return m.ID
+}
+
+// Location returns the meme's coordinates.
+func (m *Meme) Location() (lat, lon float64) {
+	return m.Lan, m.Lon
+}
+
+// ImagePathPrefix is the path that images in blob storage are served under.
+const ImagePathPrefix = "/images/"
+
+// ImageKey returns the blob storage key of the meme's image, without the watermark.
+func (m *Meme) ImageKey() string {
+	if m.SourceImage != "" {
+		return ImageKeyFromPath(m.SourceImage)
+	}
+	return ImageKeyFromPath(m.Image)
+}
+
+// ImagePath returns the path that the image stored under key is served at.
+func ImagePath(key string) string {
+	return ImagePathPrefix + key
+}
+
+// ImageKeyFromPath returns the blob storage key of an image path. Paths stored before
+// images were served by this service are the key with just a leading slash.
+func ImageKeyFromPath(p string) string {
+	if strings.HasPrefix(p, ImagePathPrefix) {
+		return strings.TrimPrefix(p, ImagePathPrefix)
+	}
+	return strings.TrimPrefix(p, "/")
+}
+
+// OriginalKey returns the blob storage key that the unmodified upload behind a public
+// image key is kept under.
+func OriginalKey(key string) string {
+	return "originals/" + key
+}
+
+// ValidateCoordinates checks that lat and lon are a valid WGS84 position, in degrees.
+func ValidateCoordinates(lat, lon float64) error {
+	if math.IsNaN(lat) || lat < -90 || lat > 90 {
+		return ErrInvalidLatitude
+	}
+
+	if math.IsNaN(lon) || lon < -180 || lon > 180 {
+		return ErrInvalidLongitude
+	}
+
+	return nil
+}
+
+// NearbyMeme is a meme together with its great-circle distance, in metres, from the
+// point a proximity search was made around.
+type NearbyMeme struct {
+	Meme
+	Distance float64 `json:"distance_m"`
+}
+
+// SimilarMeme is a meme together with the Hamming distance between its perceptual hash
+// and the one it was compared with; 0 means the images look identical.
+type SimilarMeme struct {
+	Meme
+	Distance int `json:"distance"`
 }
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MaxSearchWords is how many words a search query may have.
+const MaxSearchWords = 16
+
+var ErrEmptySearch = errors.New("q must contain at least one letter or digit")
+
+// searchWord matches the words of a search query. Everything else, including tsquery
+// operators, is ignored.
+var searchWord = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// SearchQuery is a full-text search for memes. Terms is a Postgres tsquery, as returned by
+// ParseSearchTerms. If Radius is greater than zero, only memes within Radius metres of
+// Lat and Lon are searched.
+type SearchQuery struct {
+	Terms  string
+	Lat    float64
+	Lon    float64
+	Radius float64
+	Limit  int
+}
+
+// ParseSearchTerms turns a search box query into a tsquery that matches memes containing
+// every word in it, or a word starting with it, so that "grump ca" finds "Grumpy Cat".
+func ParseSearchTerms(q string) (string, error) {
+	words := searchWord.FindAllString(strings.ToLower(q), -1)
+	if len(words) == 0 {
+		return "", ErrEmptySearch
+	}
+	if len(words) > MaxSearchWords {
+		return "", fmt.Errorf("q may have at most %d words", MaxSearchWords)
+	}
+
+	for i, word := range words {
+		words[i] = word + ":*"
+	}
+
+	return strings.Join(words, " & "), nil
+}
+
+// SearchResult is a meme found by a full-text search. Rank is how well it matched, higher
+// being better, and Distance its distance in metres from the point that the search was
+// limited to, if any. Highlight holds excerpts of its text with the matching words
+// marked.
+type SearchResult struct {
+	Meme
+	Rank      float64   `json:"rank"`
+	Distance  *float64  `json:"distance_m,omitempty"`
+	Highlight Highlight `json:"highlight"`
+}
+
+// Highlight is the text of a meme found by a search, as HTML, with the words that matched
+// wrapped in <mark> tags. Long captions and alt texts are cut down to the fragments around
+// the matches.
+type Highlight struct {
+	Title   string `json:"title,omitempty"`
+	Caption string `json:"caption,omitempty"`
+	AltText string `json:"alt_text,omitempty"`
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MaxTags is how many tags one meme may have.
+const MaxTags = 20
+
+var ErrInvalidTag = errors.New(
+	"tags must be 1 to 64 letters, digits, dashes or underscores",
+)
+
+// tagPattern matches normalised tag names.
+var tagPattern = regexp.MustCompile(`^[\p{L}\p{N}_-]{1,64}$`)
+
+// Tag is a tag together with how many public memes carry it.
+type Tag struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// NormalizeTag returns a tag name as it is stored: without a leading #, lower case, and
+// with runs of spaces turned into dashes, so that "#Cute Cats" and "cute-cats" are the
+// same tag.
+func NormalizeTag(s string) (string, error) {
+	tag := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(s), "#"))
+	tag = strings.Join(strings.Fields(tag), "-")
+
+	if !tagPattern.MatchString(tag) {
+		return "", ErrInvalidTag
+	}
+
+	return tag, nil
+}
+
+// NormalizeTags normalises each of tags, dropping duplicates and keeping their order. A
+// nil slice stays nil, which UpdateMeme takes to mean that the tags are left alone.
+func NormalizeTags(tags []string) ([]string, error) {
+	if tags == nil {
+		return nil, nil
+	}
+
+	seen := make(map[string]bool, len(tags))
+	out := make([]string, 0, len(tags))
+
+	for _, t := range tags {
+		tag, err := NormalizeTag(t)
+		if err != nil {
+			return nil, err
+		}
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		out = append(out, tag)
+	}
+
+	if len(out) > MaxTags {
+		return nil, fmt.Errorf("a meme may have at most %d tags", MaxTags)
+	}
+
+	return out, nil
+}
+
+// SplitTags splits a comma-separated list of tags, as sent in upload form fields, and
+// normalises them.
+func SplitTags(s string) ([]string, error) {
+	var tags []string
+
+	for _, t := range strings.Split(s, ",") {
+		if strings.TrimSpace(t) != "" {
+			tags = append(tags, t)
+		}
+	}
+
+	return NormalizeTags(tags)
+}
@@ -0,0 +1,104 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+var hexColor = regexp.MustCompile(`^#([0-9a-fA-F]{6}|[0-9a-fA-F]{8})$`)
+
+// MemeTemplate is a base image with named text boxes that captions are rendered into to
+// generate new memes.
+type MemeTemplate struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Image     string    `json:"image"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Boxes     []TextBox `json:"boxes"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+}
+
+// TextBox is a named area of a template that one caption is drawn into. X, Y, Width and
+// Height are in template image pixels, and FontSize is the largest size the caption is
+// drawn at; longer captions are wrapped and shrunk to fit. Colours are #rrggbb or
+// #rrggbbaa.
+type TextBox struct {
+	Name        string  `json:"name"`
+	X           int     `json:"x"`
+	Y           int     `json:"y"`
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	FontSize    float64 `json:"font_size"`
+	Align       string  `json:"align"`
+	Color       string  `json:"color"`
+	StrokeColor string  `json:"stroke_color"`
+	StrokeWidth int     `json:"stroke_width"`
+	Uppercase   bool    `json:"uppercase"`
+}
+
+// SetDefaults fills in the classic meme look for any style a text box leaves out: white,
+// centred text with a black outline.
+func (b *TextBox) SetDefaults() {
+	if b.FontSize == 0 {
+		b.FontSize = 48
+	}
+	if b.Align == "" {
+		b.Align = "center"
+	}
+	if b.Color == "" {
+		b.Color = "#ffffff"
+	}
+	if b.StrokeColor == "" {
+		b.StrokeColor = "#000000"
+	}
+}
+
+// Validate checks the template's name and that its text boxes are well formed, uniquely
+// named and inside the template image.
+func (t *MemeTemplate) Validate() error {
+	if t.Name == "" {
+		return errors.New("template name is required")
+	}
+	if len(t.Boxes) == 0 {
+		return errors.New("template needs at least one text box")
+	}
+
+	names := make(map[string]bool)
+	for _, b := range t.Boxes {
+		if b.Name == "" {
+			return errors.New("text box name is required")
+		}
+		if names[b.Name] {
+			return fmt.Errorf("text box %q is defined twice", b.Name)
+		}
+		names[b.Name] = true
+
+		if b.Width <= 0 || b.Height <= 0 || b.X < 0 || b.Y < 0 ||
+			b.X+b.Width > t.Width || b.Y+b.Height > t.Height {
+			return fmt.Errorf(
+				"text box %q must lie inside the %dx%d image",
+				b.Name,
+				t.Width,
+				t.Height,
+			)
+		}
+		if b.FontSize <= 0 {
+			return fmt.Errorf("text box %q font_size must be positive", b.Name)
+		}
+		if b.Align != "left" && b.Align != "center" && b.Align != "right" {
+			return fmt.Errorf("text box %q align must be left, center or right", b.Name)
+		}
+		if !hexColor.MatchString(b.Color) || !hexColor.MatchString(b.StrokeColor) {
+			return fmt.Errorf("text box %q colours must be #rrggbb or #rrggbbaa", b.Name)
+		}
+		if b.StrokeWidth < 0 || b.StrokeWidth > 16 {
+			return fmt.Errorf("text box %q stroke_width must be between 0 and 16", b.Name)
+		}
+	}
+
+	return nil
+}
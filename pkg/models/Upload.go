@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// Upload is a resumable upload of a meme image, made with the tus protocol. Offset is
+// how many of its Length bytes have been received so far, stored in blob storage as
+// Parts, one key per PATCH request. Metadata holds the client's Upload-Metadata, such as
+// the meme's lat, lon and visibility. Once every byte has arrived the parts are turned
+// into a meme, MemeID is set and the parts are deleted. OwnerID is the user who started
+// the upload, who alone may continue it, and who owns the meme.
+//
+// An upload that has not been added to before ExpiresAt is abandoned, and is deleted
+// along with its parts.
+type Upload struct {
+	ID        string
+	Length    int64
+	Offset    int64
+	Metadata  map[string]string
+	Parts     []string
+	OwnerID   int
+	MemeID    *int
+	ExpiresAt time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Complete reports whether every byte of the upload has been received.
+func (u *Upload) Complete() bool {
+	return u.Offset == u.Length
+}
@@ -2,19 +2,83 @@ package models
 
 import (
 	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+// User roles. Members may change the memes they own; moderators may change any meme;
+// admins may also manage templates and users.
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
+// Password length limits. bcrypt ignores everything past 72 bytes, so longer passwords
+// are refused rather than silently cut short.
+const (
+	MinPasswordLength = 8
+	MaxPasswordBytes  = 72
+)
+
+// passwordCost is the bcrypt cost that new passwords are hashed with.
+const passwordCost = 12
+
+var (
+	ErrInvalidRole  = errors.New("role must be admin, moderator or member")
+	ErrInvalidEmail = errors.New("email must be a valid email address")
+	ErrNameTooLong  = errors.New("first_name and last_name must be at most 255 characters")
+	ErrBadPassword  = fmt.Errorf(
+		"password must be at least %d characters and at most %d bytes",
+		MinPasswordLength,
+		MaxPasswordBytes,
+	)
+)
+
+// User is someone who can log in to the API. Role is one of RoleAdmin, RoleModerator or
+// RoleMember, and is carried in the user's access tokens. Users may only log in once their
+// email address has been verified, at EmailVerifiedAt. TokenVersion is carried in refresh
+// tokens, and goes up when the password is reset so that older ones stop working.
 type User struct {
-	ID        int       `json:"id"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	Password  string    `json:"password"`
-	CreatedAt time.Time `json:"-"`
-	UpdatedAt time.Time `json:"-"`
+	ID              int        `json:"id"`
+	FirstName       string     `json:"first_name"`
+	LastName        string     `json:"last_name"`
+	Email           string     `json:"email"`
+	Password        string     `json:"password"`
+	Role            string     `json:"role"`
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+	TokenVersion    int        `json:"-"`
+	CreatedAt       time.Time  `json:"-"`
+	UpdatedAt       time.Time  `json:"-"`
+}
+
+// Validate checks that the user's names fit in the database.
+func (u *User) Validate() error {
+	if utf8.RuneCountInString(u.FirstName) > 255 || utf8.RuneCountInString(u.LastName) > 255 {
+		return ErrNameTooLong
+	}
+
+	return nil
+}
+
+// SetPassword checks the length of a new password, and stores its bcrypt hash.
+func (u *User) SetPassword(plainText string) error {
+	if utf8.RuneCountInString(plainText) < MinPasswordLength || len(plainText) > MaxPasswordBytes {
+		return ErrBadPassword
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(plainText), passwordCost)
+	if err != nil {
+		return err
+	}
+
+	u.Password = string(hash)
+	return nil
 }
 
 func (u *User) PasswordMatches(plainText string) (bool, error) {
@@ -31,3 +95,43 @@ func (u *User) PasswordMatches(plainText string) (bool, error) {
 
 	return true, nil
 }
+
+// IsAdmin reports whether the user is an admin.
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// CanModerate reports whether the user may change other users' memes.
+func (u *User) CanModerate() bool {
+	return u.Role == RoleAdmin || u.Role == RoleModerator
+}
+
+// CanChange reports whether the user may update or delete meme: admins and moderators may
+// change any meme, and members only their own. Memes without an owner are left to
+// moderators.
+func (u *User) CanChange(meme *Meme) bool {
+	return u.CanModerate() || meme.OwnedBy(u.ID)
+}
+
+// ValidateRole checks that role is a known user role.
+func ValidateRole(role string) error {
+	switch role {
+	case RoleAdmin, RoleModerator, RoleMember:
+		return nil
+	default:
+		return ErrInvalidRole
+	}
+}
+
+// NormalizeEmail checks that s is a bare email address, such as jane@example.com, and
+// returns it in lower case, as it is stored.
+func NormalizeEmail(s string) (string, error) {
+	s = strings.TrimSpace(s)
+
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Address != s || len(s) > 255 {
+		return "", ErrInvalidEmail
+	}
+
+	return strings.ToLower(s), nil
+}
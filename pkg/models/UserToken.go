@@ -0,0 +1,58 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// Purposes of user tokens.
+const (
+	TokenVerifyEmail   = "verify_email"
+	TokenResetPassword = "reset_password"
+)
+
+// UserToken is a single-use secret emailed to a user, such as an email verification or
+// password reset link.
+// Only a hash of the secret is stored, so that the database alone cannot be used to
+// follow the link. Email verification tokens carry the bcrypt hash of the password they
+// were registered with in Password, which following the link sets, so that someone else
+// registering the same address cannot choose the password of the account it verifies.
+type UserToken struct {
+	Hash      string
+	UserID    int
+	Purpose   string
+	Password  string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// NewUserToken returns a random secret for a user token with the given purpose, which
+// expires after ttl, and the token to store for it.
+func NewUserToken(userID int, purpose string, ttl time.Duration) (string, UserToken, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", UserToken{}, err
+	}
+
+	secret := base64.RawURLEncoding.EncodeToString(b)
+
+	return secret, UserToken{
+		Hash:      HashUserToken(secret),
+		UserID:    userID,
+		Purpose:   purpose,
+		ExpiresAt: time.Now().Add(ttl),
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+// HashUserToken returns the hash that a user token secret is stored and looked up by.
+// The secrets are random, so a plain SHA-256 is enough.
+func HashUserToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,28 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrBlobNotFound is returned by BlobStorage.Get when no blob is stored under a key.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// Blob is an open stored object. Callers must Close it.
+type Blob struct {
+	io.ReadSeekCloser
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// BlobStorage stores the bytes of meme images by key, so that handlers never need to know
+// whether they live on local disk or in an object store shared between API replicas.
+// Keys are slash-separated relative paths, such as "ab12...ef.jpg".
+type BlobStorage interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (*Blob, error)
+	Delete(ctx context.Context, key string) error
+}
@@ -0,0 +1,94 @@
+package blobrepo
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/sdblg/meme/pkg/repository"
+)
+
+// LocalBlobRepo stores blobs as files under Dir. It is only suitable for a single API
+// replica, or for replicas sharing Dir over a network filesystem.
+type LocalBlobRepo struct {
+	Dir string
+}
+
+// Put writes the blob to a temporary file and renames it into place, so that readers never
+// see a partially written file. The content type is not stored; Get derives it from the
+// key's extension.
+func (m *LocalBlobRepo) Put(
+	ctx context.Context,
+	key string,
+	r io.Reader,
+	size int64,
+	contentType string,
+) error {
+	name := m.path(key)
+
+	err := os.MkdirAll(filepath.Dir(name), 0o755)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
+
+// Get opens the blob stored under key.
+func (m *LocalBlobRepo) Get(ctx context.Context, key string) (*repository.Blob, error) {
+	f, err := os.Open(m.path(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, repository.ErrBlobNotFound
+		}
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &repository.Blob{
+		ReadSeekCloser: f,
+		Size:           info.Size(),
+		ContentType:    mime.TypeByExtension(path.Ext(key)),
+		ModTime:        info.ModTime(),
+	}, nil
+}
+
+// Delete removes the blob stored under key. Deleting a missing blob is not an error.
+func (m *LocalBlobRepo) Delete(ctx context.Context, key string) error {
+	err := os.Remove(m.path(key))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// path maps key to a file under Dir. Cleaning the key as an absolute path first strips
+// any leading "../" so that a key can never escape Dir.
+func (m *LocalBlobRepo) path(key string) string {
+	return filepath.Join(m.Dir, filepath.FromSlash(path.Clean("/"+key)))
+}
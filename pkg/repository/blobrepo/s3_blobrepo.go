@@ -0,0 +1,61 @@
+package blobrepo
+
+import (
+	"context"
+	"io"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/sdblg/meme/pkg/repository"
+)
+
+// S3BlobRepo stores blobs as objects in an S3-compatible bucket, such as AWS S3 or MinIO.
+type S3BlobRepo struct {
+	Client *minio.Client
+	Bucket string
+}
+
+// Put uploads the blob. size may be -1 if it is not known in advance.
+func (m *S3BlobRepo) Put(
+	ctx context.Context,
+	key string,
+	r io.Reader,
+	size int64,
+	contentType string,
+) error {
+	_, err := m.Client.PutObject(ctx, m.Bucket, key, r, size, minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+
+	return err
+}
+
+// Get opens the object stored under key. Reads are fetched lazily, and seeking issues
+// ranged GETs, so large objects are never buffered whole.
+func (m *S3BlobRepo) Get(ctx context.Context, key string) (*repository.Blob, error) {
+	obj, err := m.Client.GetObject(ctx, m.Bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, repository.ErrBlobNotFound
+		}
+		return nil, err
+	}
+
+	return &repository.Blob{
+		ReadSeekCloser: obj,
+		Size:           info.Size,
+		ContentType:    info.ContentType,
+		ModTime:        info.LastModified,
+	}, nil
+}
+
+// Delete removes the object stored under key. Deleting a missing object is not an error.
+func (m *S3BlobRepo) Delete(ctx context.Context, key string) error {
+	return m.Client.RemoveObject(ctx, m.Bucket, key, minio.RemoveObjectOptions{})
+}
@@ -3,7 +3,10 @@ package dbrepo
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"html"
+	"strings"
 	"time"
 
 	"github.com/sdblg/meme/pkg/models"
@@ -19,28 +22,114 @@ type PostgresDBRepo struct {
 
 const dbTimeout = time.Second * 3
 
+// memeColumns is the select list that scanMeme expects, in order. A meme's tags are
+// gathered into a JSON array, in name order.
+const memeColumns = `id, lat, lon, coalesce(image, ''), coalesce(watermarked_image, ''),
+	variants, captured_at,
+	phash, duplicate_of, coalesce(media_type, ''), coalesce(width, 0), coalesce(height, 0),
+	frame_count, duration_ms, visibility, coalesce(blurhash, ''), watermark,
+	coalesce(title, ''), coalesce(caption, ''), coalesce(alt_text, ''),
+	coalesce((
+		select json_agg(tags.name order by tags.name)
+		from meme_tags join tags on tags.id = meme_tags.tag_id
+		where meme_tags.meme_id = memes.id
+	), '[]'),
+	owner_id, created_at, updated_at`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMeme scans a row selected with memeColumns into meme. Any extra destinations are
+// scanned from the columns that follow memeColumns.
+func scanMeme(row rowScanner, meme *models.Meme, extra ...interface{}) error {
+	var variants, tags []byte
+	var capturedAt sql.NullTime
+	var phash sql.NullInt64
+	var duplicateOf, ownerID sql.NullInt32
+	var watermark bool
+	var watermarkedImage string
+
+	dest := []interface{}{
+		&meme.ID,
+		&meme.Lan,
+		&meme.Lon,
+		&meme.Image,
+		&watermarkedImage,
+		&variants,
+		&capturedAt,
+		&phash,
+		&duplicateOf,
+		&meme.MediaType,
+		&meme.Width,
+		&meme.Height,
+		&meme.FrameCount,
+		&meme.DurationMS,
+		&meme.Visibility,
+		&meme.BlurHash,
+		&watermark,
+		&meme.Title,
+		&meme.Caption,
+		&meme.AltText,
+		&tags,
+		&ownerID,
+		&meme.CreatedAt,
+		&meme.UpdatedAt,
+	}
+
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return err
+	}
+
+	if capturedAt.Valid {
+		meme.CapturedAt = &capturedAt.Time
+	}
+	if phash.Valid {
+		meme.PHash = &phash.Int64
+	}
+	if duplicateOf.Valid {
+		id := int(duplicateOf.Int32)
+		meme.DuplicateOf = &id
+	}
+	if ownerID.Valid {
+		id := int(ownerID.Int32)
+		meme.OwnerID = &id
+	}
+	meme.Watermark = &watermark
+	if watermarkedImage != "" {
+		meme.SourceImage, meme.Image = meme.Image, watermarkedImage
+	}
+
+	err = json.Unmarshal(tags, &meme.Tags)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(variants, &meme.Variants)
+}
+
 // Connection returns underlying connection pool.
 func (m *PostgresDBRepo) Connection() *sql.DB {
 	return m.DB
 }
 
-// AllMemes returns a slice of memes, sorted by name. If the optional parameter genre
-// is supplied, then only all memes for a particular genre is returned.
+// AllMemes returns a slice of public memes, sorted by latitude.
 func (m *PostgresDBRepo) AllMemes() ([]*models.Meme, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	where := ""
+	where := "where visibility = 'public'"
 
 	query := fmt.Sprintf(`
 		select
-			id, lat, lon, coalesce(image, ''),
-			created_at, updated_at
+			%s
 		from
 			memes %s
 		order by
 			lat
-	`, where)
+	`, memeColumns, where)
 
 	rows, err := m.DB.QueryContext(ctx, query)
 	if err != nil {
@@ -52,14 +141,57 @@ func (m *PostgresDBRepo) AllMemes() ([]*models.Meme, error) {
 
 	for rows.Next() {
 		var meme models.Meme
-		err := rows.Scan(
-			&meme.ID,
-			&meme.Lan,
-			&meme.Lon,
-			&meme.Image,
-			&meme.CreatedAt,
-			&meme.UpdatedAt,
+		err := scanMeme(rows, &meme)
+		if err != nil {
+			return nil, err
+		}
+
+		memes = append(memes, &meme)
+	}
+
+	return memes, nil
+}
+
+// MemesInBBox returns the public memes inside a map viewport, sorted by latitude. Boxes
+// that cross the antimeridian match on either side of it. If limit is above zero, only
+// the newest limit memes are returned.
+func (m *PostgresDBRepo) MemesInBBox(box models.BBox, limit int) ([]*models.Meme, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`
+		with newest as (
+			select
+				id
+			from
+				memes
+			where
+				visibility = 'public' and %s
+			order by
+				id desc
+			limit nullif($5, 0)
 		)
+		select
+			%s
+		from
+			memes join newest using (id)
+		order by
+			lat
+	`, bboxWhere(box), memeColumns)
+
+	rows, err := m.DB.QueryContext(ctx, query,
+		box.MinLon, box.MinLat, box.MaxLon, box.MaxLat, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var memes []*models.Meme
+
+	for rows.Next() {
+		var meme models.Meme
+		err := scanMeme(rows, &meme)
 		if err != nil {
 			return nil, err
 		}
@@ -70,26 +202,99 @@ func (m *PostgresDBRepo) AllMemes() ([]*models.Meme, error) {
 	return memes, nil
 }
 
+// clusterCellsPerTile is how many grid cells a 256px map tile is split into along each
+// axis when clustering, giving 64px clusters.
+const clusterCellsPerTile = 4
+
+// MemeClusters groups the public memes inside a viewport into a Web Mercator grid sized
+// for the given zoom level, largest clusters first. Each cluster carries its meme count,
+// the centroid of its memes and the lowest meme id in it as a sample.
+func (m *PostgresDBRepo) MemeClusters(
+	box models.BBox,
+	zoom int,
+) ([]*models.MemeCluster, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	// Latitudes are clamped to the Web Mercator limits so the poles do not project to
+	// infinity.
+	query := fmt.Sprintf(`
+		select
+			count(*), avg(lat), avg(lon), min(id)
+		from (
+			select
+				id, lat, lon,
+				floor((lon + 180) / 360 * $5) as cell_x,
+				floor(
+					(1 - ln(tan(radians(clat)) + 1 / cos(radians(clat))) / pi()) / 2 * $5
+				) as cell_y
+			from (
+				select
+					id, lat, lon,
+					greatest(least(lat, 85.0511287798), -85.0511287798) as clat
+				from
+					memes
+				where
+					visibility = 'public' and %s
+			) clamped
+		) cells
+		group by
+			cell_x, cell_y
+		order by
+			count(*) desc
+	`, bboxWhere(box))
+
+	cells := float64(int(1)<<zoom) * clusterCellsPerTile
+
+	rows, err := m.DB.QueryContext(ctx, query,
+		box.MinLon, box.MinLat, box.MaxLon, box.MaxLat, cells,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clusters []*models.MemeCluster
+
+	for rows.Next() {
+		var cluster models.MemeCluster
+		err := rows.Scan(
+			&cluster.Count,
+			&cluster.Lan,
+			&cluster.Lon,
+			&cluster.SampleID,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		clusters = append(clusters, &cluster)
+	}
+
+	return clusters, nil
+}
+
+// bboxWhere returns the where clause matching memes inside box, with the box's minLon,
+// minLat, maxLon and maxLat bound to $1 to $4.
+func bboxWhere(box models.BBox) string {
+	if box.CrossesAntimeridian() {
+		return "lat between $2 and $4 and (lon >= $1 or lon <= $3)"
+	}
+	return "lat between $2 and $4 and lon between $1 and $3"
+}
+
 // OneMeme returns a single meme and associated categories, if any.
 func (m *PostgresDBRepo) OneMeme(id int) (*models.Meme, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, lat, lon, coalesce(image, ''), created_at, updated_at
-		from memes where id = $1`
+	query := fmt.Sprintf(`select %s from memes where id = $1`, memeColumns)
 
 	row := m.DB.QueryRowContext(ctx, query, id)
 
 	var meme models.Meme
 
-	err := row.Scan(
-		&meme.ID,
-		&meme.Lan,
-		&meme.Lon,
-		&meme.Image,
-		&meme.CreatedAt,
-		&meme.UpdatedAt,
-	)
+	err := scanMeme(row, &meme)
 
 	if err != nil {
 		return nil, err
@@ -97,13 +302,110 @@ func (m *PostgresDBRepo) OneMeme(id int) (*models.Meme, error) {
 	return &meme, err
 }
 
+// NearbyMemes returns up to limit memes within radius metres of the given point, closest
+// first. The earth_box test lets Postgres use the memes_location_idx GiST index; the
+// earth_distance test then trims the box down to the actual circle.
+func (m *PostgresDBRepo) NearbyMemes(
+	lat, lon, radius float64,
+	limit int,
+) ([]*models.NearbyMeme, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`
+		select
+			%s,
+			earth_distance(ll_to_earth($1, $2), ll_to_earth(lat, lon)) as distance
+		from
+			memes
+		where
+			visibility = 'public'
+			and earth_box(ll_to_earth($1, $2), $3) @> ll_to_earth(lat, lon)
+			and earth_distance(ll_to_earth($1, $2), ll_to_earth(lat, lon)) <= $3
+		order by
+			distance
+		limit $4
+	`, memeColumns)
+
+	rows, err := m.DB.QueryContext(ctx, query, lat, lon, radius, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var memes []*models.NearbyMeme
+
+	for rows.Next() {
+		var meme models.NearbyMeme
+		err := scanMeme(rows, &meme.Meme, &meme.Distance)
+		if err != nil {
+			return nil, err
+		}
+
+		memes = append(memes, &meme)
+	}
+
+	return memes, nil
+}
+
+// SimilarMemes returns up to limit memes whose perceptual hash is within maxDistance bits
+// of hash, most similar first, leaving out the meme with id excludeID. Only public memes
+// and those owned by the user with id ownerID are returned; 0 means public ones only.
+func (m *PostgresDBRepo) SimilarMemes(
+	hash int64,
+	maxDistance, excludeID, limit, ownerID int,
+) ([]*models.SimilarMeme, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`
+		select
+			*
+		from (
+			select
+				%s,
+				bit_count((phash # $1)::bit(64))::integer as distance
+			from
+				memes
+			where
+				phash is not null and id <> $3
+				and (visibility = 'public' or owner_id = $5)
+		) hashed
+		where
+			distance <= $2
+		order by
+			distance, id
+		limit $4
+	`, memeColumns)
+
+	rows, err := m.DB.QueryContext(ctx, query, hash, maxDistance, excludeID, limit, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var memes []*models.SimilarMeme
+
+	for rows.Next() {
+		var meme models.SimilarMeme
+		err := scanMeme(rows, &meme.Meme, &meme.Distance)
+		if err != nil {
+			return nil, err
+		}
+
+		memes = append(memes, &meme)
+	}
+
+	return memes, nil
+}
+
 // GetUserByEmail returns one use, by email.
 func (m *PostgresDBRepo) GetUserByEmail(email string) (*models.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password,
-			created_at, updated_at from users where email = $1`
+	query := `select id, email, first_name, last_name, password, role, email_verified_at,
+			token_version, created_at, updated_at from users where lower(email) = lower($1)`
 
 	var user models.User
 	row := m.DB.QueryRowContext(ctx, query, email)
@@ -114,6 +416,9 @@ func (m *PostgresDBRepo) GetUserByEmail(email string) (*models.User, error) {
 		&user.FirstName,
 		&user.LastName,
 		&user.Password,
+		&user.Role,
+		&user.EmailVerifiedAt,
+		&user.TokenVersion,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -130,8 +435,8 @@ func (m *PostgresDBRepo) GetUserByID(id int) (*models.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password,
-			created_at, updated_at from users where id = $1`
+	query := `select id, email, first_name, last_name, password, role, email_verified_at,
+			token_version, created_at, updated_at from users where id = $1`
 
 	var user models.User
 	row := m.DB.QueryRowContext(ctx, query, id)
@@ -142,6 +447,9 @@ func (m *PostgresDBRepo) GetUserByID(id int) (*models.User, error) {
 		&user.FirstName,
 		&user.LastName,
 		&user.Password,
+		&user.Role,
+		&user.EmailVerifiedAt,
+		&user.TokenVersion,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 	)
@@ -153,60 +461,1048 @@ func (m *PostgresDBRepo) GetUserByID(id int) (*models.User, error) {
 	return &user, nil
 }
 
-// InsertMeme inserts one meme into the database.
-func (m *PostgresDBRepo) InsertMeme(meme models.Meme) (int, error) {
+// RegisterUser inserts a new, unverified user, and returns their ID. Registering again
+// with the email address of a user who has not verified it yet replaces their name
+// instead, but not their password, which only the verification link sets. If a verified
+// user already has the address, it returns sql.ErrNoRows.
+func (m *PostgresDBRepo) RegisterUser(user models.User) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	stmt := `insert into memes (lat, lon, image)
-			values ($1, $2, $3) returning id`
+	stmt := `insert into users (first_name, last_name, email, password, role, created_at,
+				updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7)
+			on conflict ((lower(email))) do update
+				set first_name = excluded.first_name, last_name = excluded.last_name,
+					updated_at = excluded.updated_at
+				where users.email_verified_at is null
+			returning id`
 
-	var newID int
+	var id int
 
 	err := m.DB.QueryRowContext(ctx, stmt,
-		meme.Lan,
-		meme.Lon,
-		meme.CreatedAt,
-		meme.UpdatedAt,
-		meme.Image,
-	).Scan(&newID)
-
+		user.FirstName,
+		user.LastName,
+		user.Email,
+		user.Password,
+		user.Role,
+		user.CreatedAt,
+		user.UpdatedAt,
+	).Scan(&id)
 	if err != nil {
 		return 0, err
 	}
 
-	return newID, nil
+	return id, nil
 }
 
-// UpdateMeme updates one meme in the database.
-func (m *PostgresDBRepo) UpdateMeme(meme models.Meme) error {
+// InsertUserToken stores a user token, replacing any earlier tokens of the user for the
+// same purpose so that only the latest one can be used. Earlier email verification tokens
+// are kept, since each sets the password it was registered with: whoever registered first
+// must still be able to follow their own link.
+func (m *PostgresDBRepo) InsertUserToken(token models.UserToken) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	stmt := `update memes set lat = $1, lon = $2, 
-				updated_at = $3, image = $4 where id = $5`
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	_, err := m.DB.ExecContext(ctx, stmt,
-		meme.Lan,
-		meme.Lon,
-		meme.UpdatedAt,
-		meme.Image,
-		meme.ID,
+	if token.Purpose != models.TokenVerifyEmail {
+		_, err = tx.ExecContext(ctx,
+			`delete from user_tokens where user_id = $1 and purpose = $2`,
+			token.UserID,
+			token.Purpose,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	stmt := `insert into user_tokens (token_hash, user_id, purpose, password, expires_at,
+				created_at)
+			values ($1, $2, $3, nullif($4, ''), $5, $6)`
+
+	_, err = tx.ExecContext(ctx, stmt,
+		token.Hash,
+		token.UserID,
+		token.Purpose,
+		token.Password,
+		token.ExpiresAt,
+		token.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// VerifyEmail uses up an email verification token, by hash, marks its user's email
+// address as verified and sets their password to the one registered with the token. The
+// user's other verification tokens are deleted, so that links sent to anyone else who
+// registered the address can no longer change the password. It returns sql.ErrNoRows if
+// the token is unknown, used or expired.
+func (m *PostgresDBRepo) VerifyEmail(tokenHash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userID, err := useUserToken(ctx, tx, tokenHash, models.TokenVerifyEmail)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`update users set email_verified_at = $1, updated_at = $1,
+				password = coalesce(
+					(select password from user_tokens where token_hash = $3), password)
+			where id = $2 and email_verified_at is null`,
+		time.Now(),
+		userID,
+		tokenHash,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`delete from user_tokens where user_id = $1 and purpose = $2 and used_at is null`,
+		userID,
+		models.TokenVerifyEmail,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ResetPassword uses up a password reset token, by hash, and sets its user's password to
+// the given bcrypt hash. Following the emailed link also proves that the user's email
+// address is theirs, so it counts as verified. The user's token version is bumped, so
+// that refresh tokens issued before the reset stop working. It returns sql.ErrNoRows if
+// the token is unknown, used or expired.
+func (m *PostgresDBRepo) ResetPassword(tokenHash, password string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	userID, err := useUserToken(ctx, tx, tokenHash, models.TokenResetPassword)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`update users set password = $1, token_version = token_version + 1,
+				email_verified_at = coalesce(email_verified_at, $2), updated_at = $2
+			where id = $3`,
+		password,
+		time.Now(),
+		userID,
 	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// useUserToken marks an unused, unexpired user token with the given hash and purpose as
+// used, and returns its user's ID. It returns sql.ErrNoRows if there is no such token.
+func useUserToken(ctx context.Context, tx *sql.Tx, hash, purpose string) (int, error) {
+	var userID int
+
+	err := tx.QueryRowContext(ctx,
+		`update user_tokens set used_at = $1
+			where token_hash = $2 and purpose = $3 and used_at is null and expires_at > $1
+			returning user_id`,
+		time.Now(),
+		hash,
+		purpose,
+	).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return userID, nil
+}
 
+// UpdateUserRole changes a user's role. It returns sql.ErrNoRows if there is no such user.
+func (m *PostgresDBRepo) UpdateUserRole(id int, role string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set role = $1, updated_at = $2 where id = $3`
+
+	res, err := m.DB.ExecContext(ctx, stmt, role, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
 	if err != nil {
 		return err
 	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
 
 	return nil
 }
 
-// DeleteMeme deletes one meme, by id.
-func (m *PostgresDBRepo) DeleteMeme(id int) error {
+// InsertMeme inserts one meme into the database, along with its tags.
+func (m *PostgresDBRepo) InsertMeme(meme models.Meme) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	stmt := `delete from memes where id = $1`
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt := `insert into memes (lat, lon, image, captured_at, phash, duplicate_of,
+				media_type, width, height, frame_count, duration_ms, visibility,
+				blurhash, watermark, title, caption, alt_text, owner_id, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, nullif($7, ''), nullif($8, 0), nullif($9, 0),
+				greatest($10, 1), $11, coalesce(nullif($12, ''), 'public'), nullif($13, ''),
+				coalesce($14, true), nullif($15, ''), nullif($16, ''), nullif($17, ''),
+				$18, $19, $20)
+			returning id`
+
+	var newID int
+
+	err = tx.QueryRowContext(ctx, stmt,
+		meme.Lan,
+		meme.Lon,
+		meme.Image,
+		meme.CapturedAt,
+		meme.PHash,
+		meme.DuplicateOf,
+		meme.MediaType,
+		meme.Width,
+		meme.Height,
+		meme.FrameCount,
+		meme.DurationMS,
+		meme.Visibility,
+		meme.BlurHash,
+		meme.Watermark,
+		meme.Title,
+		meme.Caption,
+		meme.AltText,
+		meme.OwnerID,
+		meme.CreatedAt,
+		meme.UpdatedAt,
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = setMemeTags(ctx, tx, newID, meme.Tags)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, tx.Commit()
+}
+
+// UpdateMeme updates one meme in the database. Its tags are replaced, unless meme.Tags is
+// nil.
+func (m *PostgresDBRepo) UpdateMeme(meme models.Meme) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The stored image is the one without the watermark.
+	image := meme.Image
+	if meme.SourceImage != "" {
+		image = meme.SourceImage
+	}
+
+	stmt := `update memes set lat = $1, lon = $2, 
+				updated_at = $3, image = $4,
+				visibility = coalesce(nullif($5, ''), 'public'),
+				watermark = coalesce($6, watermark),
+				title = nullif($7, ''), caption = nullif($8, ''), alt_text = nullif($9, '')
+			where id = $10`
+
+	_, err = tx.ExecContext(ctx, stmt,
+		meme.Lan,
+		meme.Lon,
+		meme.UpdatedAt,
+		image,
+		meme.Visibility,
+		meme.Watermark,
+		meme.Title,
+		meme.Caption,
+		meme.AltText,
+		meme.ID,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	if meme.Tags != nil {
+		_, err = tx.ExecContext(ctx, `delete from meme_tags where meme_id = $1`, meme.ID)
+		if err != nil {
+			return err
+		}
+
+		err = setMemeTags(ctx, tx, meme.ID, meme.Tags)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// setMemeTags tags a meme with each of tags, creating the tags that do not exist yet.
+func setMemeTags(ctx context.Context, tx *sql.Tx, id int, tags []string) error {
+	for _, tag := range tags {
+		_, err := tx.ExecContext(ctx,
+			`insert into tags (name) values ($1) on conflict (name) do nothing`,
+			tag,
+		)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx,
+			`insert into meme_tags (meme_id, tag_id)
+				select $1, id from tags where name = $2
+			on conflict do nothing`,
+			id,
+			tag,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UpdateMemeVariants replaces the resized variants recorded for one meme, and the path of
+// its full size watermarked image, which is empty if it is not watermarked.
+func (m *PostgresDBRepo) UpdateMemeVariants(
+	id int,
+	variants map[string]string,
+	watermarkedImage string,
+) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	data, err := json.Marshal(variants)
+	if err != nil {
+		return err
+	}
+
+	stmt := `update memes set variants = $1, watermarked_image = nullif($2, ''),
+				updated_at = $3
+			where id = $4`
+
+	_, err = m.DB.ExecContext(ctx, stmt, data, watermarkedImage, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdateMemeBlurHash sets the BlurHash placeholder of one meme.
+func (m *PostgresDBRepo) UpdateMemeBlurHash(id int, hash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update memes set blurhash = $1, updated_at = $2 where id = $3`
+
+	_, err := m.DB.ExecContext(ctx, stmt, hash, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AllMemeIDs returns the ids of every meme, whatever its visibility, in order.
+func (m *PostgresDBRepo) AllMemeIDs() ([]int, error) {
+	return m.memeIDs(`select id from memes order by id`)
+}
+
+// MemeIDsWithoutBlurHash returns the ids of the memes that have an image but no BlurHash
+// placeholder yet, in order.
+func (m *PostgresDBRepo) MemeIDsWithoutBlurHash() ([]int, error) {
+	return m.memeIDs(`
+		select
+			id
+		from
+			memes
+		where
+			blurhash is null and coalesce(image, '') <> ''
+		order by
+			id
+	`)
+}
+
+// memeIDs runs a query selecting just meme ids.
+func (m *PostgresDBRepo) memeIDs(query string) ([]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// ImageIsPublic reports whether the image whose storage key is named after digest, or any
+// of its variants, may be served without a signed URL: that is, if a public meme uses it.
+// Images no meme uses are only public if they are templates, so that the images of
+// deleted memes, which are left in storage, are not published. If unmarked is set, the
+// image is a meme's own image or a variant without the watermark, which is only public if
+// it is used by a public meme that is not watermarked.
+func (m *PostgresDBRepo) ImageIsPublic(digest string, template, unmarked bool) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+		select
+			coalesce(bool_or(visibility = 'public' and not ($3 and watermark)), $2)
+		from
+			memes
+		where
+			image like $1
+	`
+
+	var public bool
+
+	row := m.DB.QueryRowContext(
+		ctx,
+		query,
+		models.ImagePath(digest)+".%",
+		template,
+		unmarked,
+	)
+
+	err := row.Scan(&public)
+	if err != nil {
+		return false, err
+	}
+
+	return public, nil
+}
+
+// LegacyImageIsPublic reports whether the image stored under a key that is not named
+// after its content may be served without a signed URL: that is, if a public meme uses
+// it as its image or one of its variants, or no meme does. If unmarked is set, the image
+// is only public if the meme is not watermarked either. Memes stored before images were
+// served by this service have paths that are the key with just a leading slash.
+func (m *PostgresDBRepo) LegacyImageIsPublic(key string, unmarked bool) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+		select
+			coalesce(bool_or(visibility = 'public' and not ($3 and watermark)), true)
+		from
+			memes
+		where
+			image in ($1, $2)
+			or watermarked_image = $1
+			or exists (select from jsonb_each_text(variants) v where v.value = $1)
+	`
+
+	var public bool
+
+	row := m.DB.QueryRowContext(ctx, query, models.ImagePath(key), "/"+key, unmarked)
+
+	err := row.Scan(&public)
+	if err != nil {
+		return false, err
+	}
+
+	return public, nil
+}
+
+// DeleteMeme deletes one meme, by id.
+func (m *PostgresDBRepo) DeleteMeme(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from memes where id = $1`
+
+	_, err := m.DB.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AllTags returns the tags of public memes with how many public memes carry each, most
+// used first.
+func (m *PostgresDBRepo) AllTags() ([]*models.Tag, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+		select
+			tags.name, count(*)
+		from
+			tags
+			join meme_tags on meme_tags.tag_id = tags.id
+			join memes on memes.id = meme_tags.meme_id
+		where
+			memes.visibility = 'public'
+		group by
+			tags.name
+		order by
+			count(*) desc, tags.name
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []*models.Tag
+
+	for rows.Next() {
+		var tag models.Tag
+		err := rows.Scan(&tag.Name, &tag.Count)
+		if err != nil {
+			return nil, err
+		}
+
+		tags = append(tags, &tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// MemesWithTag returns the public memes tagged with tag, newest first.
+func (m *PostgresDBRepo) MemesWithTag(tag string) ([]*models.Meme, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`
+		select
+			%s
+		from
+			memes
+		where
+			visibility = 'public' and id in (
+				select meme_tags.meme_id
+				from meme_tags join tags on tags.id = meme_tags.tag_id
+				where tags.name = $1
+			)
+		order by
+			id desc
+	`, memeColumns)
+
+	rows, err := m.DB.QueryContext(ctx, query, tag)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var memes []*models.Meme
+
+	for rows.Next() {
+		var meme models.Meme
+		err := scanMeme(rows, &meme)
+		if err != nil {
+			return nil, err
+		}
+
+		memes = append(memes, &meme)
+	}
+
+	return memes, rows.Err()
+}
+
+// MemesByOwner returns the memes owned by the user with the given ID, newest first. If
+// publicOnly is set, only their public memes are returned.
+func (m *PostgresDBRepo) MemesByOwner(ownerID int, publicOnly bool) ([]*models.Meme, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`
+		select
+			%s
+		from
+			memes
+		where
+			owner_id = $1
+			and (not $2 or visibility = 'public')
+		order by
+			id desc
+	`, memeColumns)
+
+	rows, err := m.DB.QueryContext(ctx, query, ownerID, publicOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var memes []*models.Meme
+
+	for rows.Next() {
+		var meme models.Meme
+		err := scanMeme(rows, &meme)
+		if err != nil {
+			return nil, err
+		}
+
+		memes = append(memes, &meme)
+	}
+
+	return memes, rows.Err()
+}
+
+// Sentinels that ts_headline marks matches with. They are swapped for <mark> tags once
+// the rest of the text has been HTML escaped.
+const (
+	highlightStart = "\ue000"
+	highlightStop  = "\ue001"
+)
+
+// Options for ts_headline: titles are highlighted whole, while captions and alt texts are
+// cut down to the fragments around the matches.
+var (
+	titleHeadline = headlineOptions("HighlightAll=true")
+	textHeadline  = headlineOptions(
+		`MaxFragments=2, MaxWords=20, MinWords=8, FragmentDelimiter=" … "`,
+	)
+)
+
+// headlineOptions returns ts_headline options that mark matches with the sentinels.
+func headlineOptions(options string) string {
+	return fmt.Sprintf(`StartSel="%s", StopSel="%s", %s`, highlightStart, highlightStop, options)
+}
+
+// highlighter turns ts_headline output into HTML.
+var highlighter = strings.NewReplacer(highlightStart, "<mark>", highlightStop, "</mark>")
+
+// SearchMemes returns up to query.Limit public memes whose title, tags, caption or alt
+// text match query.Terms, best match first. Matches are ranked in the inner query, using
+// the memes_search_idx GIN index, so that only the memes returned are highlighted.
+func (m *PostgresDBRepo) SearchMemes(query models.SearchQuery) ([]*models.SearchResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := fmt.Sprintf(`
+		select
+			%s,
+			matches.rank,
+			matches.distance,
+			ts_headline('english', coalesce(title, ''), matches.query, $5),
+			ts_headline('english', coalesce(caption, ''), matches.query, $6),
+			ts_headline('english', coalesce(alt_text, ''), matches.query, $6)
+		from (
+			select
+				id as meme_id,
+				query,
+				ts_rank(search, query) as rank,
+				case
+					when $4::float8 > 0
+					then earth_distance(ll_to_earth($2, $3), ll_to_earth(lat, lon))
+				end as distance
+			from
+				memes,
+				to_tsquery('english', $1) query
+			where
+				visibility = 'public'
+				and search @@ query
+				and ($4::float8 = 0 or (
+					earth_box(ll_to_earth($2, $3), $4::float8) @> ll_to_earth(lat, lon)
+					and earth_distance(ll_to_earth($2, $3), ll_to_earth(lat, lon)) <= $4::float8
+				))
+			order by
+				rank desc, id desc
+			limit $7
+		) matches
+		join memes on memes.id = matches.meme_id
+		order by
+			matches.rank desc, matches.meme_id desc
+	`, memeColumns)
+
+	rows, err := m.DB.QueryContext(ctx, stmt,
+		query.Terms,
+		query.Lat,
+		query.Lon,
+		query.Radius,
+		titleHeadline,
+		textHeadline,
+		query.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []*models.SearchResult
+
+	for rows.Next() {
+		var result models.SearchResult
+		var distance sql.NullFloat64
+		var title, caption, altText string
+
+		err := scanMeme(rows, &result.Meme, &result.Rank, &distance, &title, &caption, &altText)
+		if err != nil {
+			return nil, err
+		}
+
+		if distance.Valid {
+			result.Distance = &distance.Float64
+		}
+		result.Highlight = models.Highlight{
+			Title:   highlight(title),
+			Caption: highlight(caption),
+			AltText: highlight(altText),
+		}
+
+		results = append(results, &result)
+	}
+
+	return results, rows.Err()
+}
+
+// highlight escapes ts_headline output for HTML, then marks its matches.
+func highlight(headline string) string {
+	return highlighter.Replace(html.EscapeString(headline))
+}
+
+// templateColumns is the select list that scanTemplate expects, in order.
+const templateColumns = `id, name, image, width, height, boxes, created_at, updated_at`
+
+// scanTemplate scans a row selected with templateColumns into template.
+func scanTemplate(row rowScanner, template *models.MemeTemplate) error {
+	var boxes []byte
+
+	err := row.Scan(
+		&template.ID,
+		&template.Name,
+		&template.Image,
+		&template.Width,
+		&template.Height,
+		&boxes,
+		&template.CreatedAt,
+		&template.UpdatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(boxes, &template.Boxes)
+}
+
+// AllTemplates returns every meme template, sorted by name.
+func (m *PostgresDBRepo) AllTemplates() ([]*models.MemeTemplate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`select %s from meme_templates order by name`, templateColumns)
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var templates []*models.MemeTemplate
+
+	for rows.Next() {
+		var template models.MemeTemplate
+		err := scanTemplate(rows, &template)
+		if err != nil {
+			return nil, err
+		}
+
+		templates = append(templates, &template)
+	}
+
+	return templates, nil
+}
+
+// OneTemplate returns a single meme template, by id.
+func (m *PostgresDBRepo) OneTemplate(id int) (*models.MemeTemplate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`select %s from meme_templates where id = $1`, templateColumns)
+
+	var template models.MemeTemplate
+
+	err := scanTemplate(m.DB.QueryRowContext(ctx, query, id), &template)
+	if err != nil {
+		return nil, err
+	}
+
+	return &template, nil
+}
+
+// InsertTemplate inserts one meme template into the database.
+func (m *PostgresDBRepo) InsertTemplate(template models.MemeTemplate) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	boxes, err := json.Marshal(template.Boxes)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt := `insert into meme_templates (name, image, width, height, boxes,
+				created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7) returning id`
+
+	var newID int
+
+	err = m.DB.QueryRowContext(ctx, stmt,
+		template.Name,
+		template.Image,
+		template.Width,
+		template.Height,
+		boxes,
+		template.CreatedAt,
+		template.UpdatedAt,
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// DeleteTemplate deletes one meme template, by id. Memes generated from it are kept.
+func (m *PostgresDBRepo) DeleteTemplate(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from meme_templates where id = $1`
+
+	_, err := m.DB.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// uploadColumns is the select list that scanUpload expects, in order.
+const uploadColumns = `id, length, upload_offset, metadata, parts, meme_id,
+	coalesce(owner_id, 0), expires_at, created_at, updated_at`
+
+// scanUpload scans a row selected with uploadColumns into upload.
+func scanUpload(row rowScanner, upload *models.Upload) error {
+	var metadata, parts []byte
+	var memeID sql.NullInt32
+
+	err := row.Scan(
+		&upload.ID,
+		&upload.Length,
+		&upload.Offset,
+		&metadata,
+		&parts,
+		&memeID,
+		&upload.OwnerID,
+		&upload.ExpiresAt,
+		&upload.CreatedAt,
+		&upload.UpdatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	if memeID.Valid {
+		id := int(memeID.Int32)
+		upload.MemeID = &id
+	}
+
+	err = json.Unmarshal(metadata, &upload.Metadata)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(parts, &upload.Parts)
+}
+
+// OneUpload returns a single resumable upload, by id.
+func (m *PostgresDBRepo) OneUpload(id string) (*models.Upload, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`select %s from uploads where id = $1`, uploadColumns)
+
+	var upload models.Upload
+
+	err := scanUpload(m.DB.QueryRowContext(ctx, query, id), &upload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upload, nil
+}
+
+// ExpiredUploads returns the resumable uploads that expired before t.
+func (m *PostgresDBRepo) ExpiredUploads(t time.Time) ([]*models.Upload, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`
+		select
+			%s
+		from
+			uploads
+		where
+			expires_at < $1
+		order by
+			expires_at
+	`, uploadColumns)
+
+	rows, err := m.DB.QueryContext(ctx, query, t)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uploads []*models.Upload
+
+	for rows.Next() {
+		var upload models.Upload
+		err := scanUpload(rows, &upload)
+		if err != nil {
+			return nil, err
+		}
+
+		uploads = append(uploads, &upload)
+	}
+
+	return uploads, rows.Err()
+}
+
+// InsertUpload starts a resumable upload, with nothing received yet.
+func (m *PostgresDBRepo) InsertUpload(upload models.Upload) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	metadata, err := json.Marshal(upload.Metadata)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into uploads (id, length, metadata, owner_id, expires_at, created_at,
+				updated_at)
+			values ($1, $2, $3, nullif($4, 0), $5, $6, $7)`
+
+	_, err = m.DB.ExecContext(ctx, stmt,
+		upload.ID,
+		upload.Length,
+		metadata,
+		upload.OwnerID,
+		upload.ExpiresAt,
+		upload.CreatedAt,
+		upload.UpdatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AppendUploadPart records that size more bytes of an upload have been stored under key,
+// and pushes back its expiry. It only succeeds while the upload's offset is still offset,
+// so that of two requests racing to continue an upload from the same point, only one is
+// kept; it reports whether this one was.
+func (m *PostgresDBRepo) AppendUploadPart(
+	id string,
+	offset, size int64,
+	key string,
+	expiresAt time.Time,
+) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update uploads set upload_offset = upload_offset + $1,
+				parts = parts || jsonb_build_array($2::text),
+				expires_at = $3, updated_at = $4
+			where id = $5 and upload_offset = $6 and upload_offset + $1 <= length`
+
+	res, err := m.DB.ExecContext(ctx, stmt, size, key, expiresAt, time.Now(), id, offset)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// CompleteUpload records the meme a finished upload was turned into, and forgets its
+// parts, which the caller deletes.
+func (m *PostgresDBRepo) CompleteUpload(id string, memeID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update uploads set meme_id = $1, parts = '[]', updated_at = $2 where id = $3`
+
+	_, err := m.DB.ExecContext(ctx, stmt, memeID, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteUpload deletes one resumable upload, by id. Its parts must be deleted from blob
+// storage separately.
+func (m *PostgresDBRepo) DeleteUpload(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from uploads where id = $1`
 
 	_, err := m.DB.ExecContext(ctx, stmt, id)
 	if err != nil {
@@ -2,6 +2,7 @@ package repository
 
 import (
 	"database/sql"
+	"time"
 
 	"github.com/sdblg/meme/pkg/models"
 )
@@ -11,11 +12,46 @@ type DatabaseRepo interface {
 
 	GetUserByEmail(email string) (*models.User, error)
 	GetUserByID(id int) (*models.User, error)
+	UpdateUserRole(id int, role string) error
+	RegisterUser(user models.User) (int, error)
+	InsertUserToken(token models.UserToken) error
+	VerifyEmail(tokenHash string) error
+	ResetPassword(tokenHash, password string) error
 
 	AllMemes() ([]*models.Meme, error)
+	AllMemeIDs() ([]int, error)
+	MemeIDsWithoutBlurHash() ([]int, error)
 	OneMeme(id int) (*models.Meme, error)
+	MemesInBBox(box models.BBox, limit int) ([]*models.Meme, error)
+	MemeClusters(box models.BBox, zoom int) ([]*models.MemeCluster, error)
+	NearbyMemes(lat, lon, radius float64, limit int) ([]*models.NearbyMeme, error)
+	SimilarMemes(
+		hash int64,
+		maxDistance, excludeID, limit, ownerID int,
+	) ([]*models.SimilarMeme, error)
+	ImageIsPublic(digest string, template, unmarked bool) (bool, error)
+	LegacyImageIsPublic(key string, unmarked bool) (bool, error)
+
+	AllTags() ([]*models.Tag, error)
+	MemesWithTag(tag string) ([]*models.Meme, error)
+	MemesByOwner(ownerID int, publicOnly bool) ([]*models.Meme, error)
+	SearchMemes(query models.SearchQuery) ([]*models.SearchResult, error)
 
 	InsertMeme(meme models.Meme) (int, error)
 	UpdateMeme(meme models.Meme) error
+	UpdateMemeVariants(id int, variants map[string]string, watermarkedImage string) error
+	UpdateMemeBlurHash(id int, hash string) error
 	DeleteMeme(id int) error
+
+	AllTemplates() ([]*models.MemeTemplate, error)
+	OneTemplate(id int) (*models.MemeTemplate, error)
+	InsertTemplate(template models.MemeTemplate) (int, error)
+	DeleteTemplate(id int) error
+
+	OneUpload(id string) (*models.Upload, error)
+	ExpiredUploads(t time.Time) ([]*models.Upload, error)
+	InsertUpload(upload models.Upload) error
+	AppendUploadPart(id string, offset, size int64, key string, expiresAt time.Time) (bool, error)
+	CompleteUpload(id string, memeID int) error
+	DeleteUpload(id string) error
 }
@@ -21,10 +21,14 @@ type Auth struct {
 	CookieName    string
 }
 
+// JwtUser is the user that a token pair is generated for. TokenVersion is recorded in the
+// refresh token, which is refused once the user's token version has moved on.
 type JwtUser struct {
-	ID        int    `json:"id"`
-	FirstName string `json:"first_name"`
-	LastName  string `json:"last_name"`
+	ID           int    `json:"id"`
+	FirstName    string `json:"first_name"`
+	LastName     string `json:"last_name"`
+	Role         string `json:"role"`
+	TokenVersion int    `json:"-"`
 }
 
 type TokenPairs struct {
@@ -32,8 +36,13 @@ type TokenPairs struct {
 	RefreshToken string `json:"refresh_token"`
 }
 
+// Claims are the claims of an access or refresh token. Role is the user's role when an
+// access token was issued; a changed role only reaches the user's tokens when they are
+// next refreshed. Version is the user's token version when a refresh token was issued.
 type Claims struct {
 	jwt.RegisteredClaims
+	Role    string `json:"role"`
+	Version int    `json:"ver"`
 }
 
 func (j *Auth) GenerateTokenPair(user *JwtUser) (TokenPairs, error) {
@@ -44,6 +53,7 @@ func (j *Auth) GenerateTokenPair(user *JwtUser) (TokenPairs, error) {
 	claims := token.Claims.(jwt.MapClaims)
 	claims["name"] = fmt.Sprintf("%s %s", user.FirstName, user.LastName)
 	claims["sub"] = fmt.Sprint(user.ID)
+	claims["role"] = user.Role
 	claims["aud"] = j.Audience
 	claims["iss"] = j.Issuer
 	claims["iat"] = time.Now().UTC().Unix()
@@ -62,6 +72,7 @@ func (j *Auth) GenerateTokenPair(user *JwtUser) (TokenPairs, error) {
 	refreshToken := jwt.New(jwt.SigningMethodHS256)
 	refreshTokenClaims := refreshToken.Claims.(jwt.MapClaims)
 	refreshTokenClaims["sub"] = fmt.Sprint(user.ID)
+	refreshTokenClaims["ver"] = user.TokenVersion
 	refreshTokenClaims["iat"] = time.Now().UTC().Unix()
 
 	// Set the expiry for the refresh token
@@ -173,3 +184,27 @@ func (j *Auth) AuthRequired(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequireRole returns middleware that only lets through requests whose access token was
+// issued to a user with one of roles. Requests without a valid token get 401
+// Unauthorized, and those with another role 403 Forbidden.
+func (j *Auth) RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, claims, err := j.GetTokenFromHeaderAndVerify(w, r)
+			if err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+
+			for _, role := range roles {
+				if claims.Role == role {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			w.WriteHeader(http.StatusForbidden)
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/sdblg/meme/pkg/models"
+	"github.com/sdblg/meme/pkg/repository"
+)
+
+// Uploads looks after the resumable uploads that clients send meme images in: it deletes
+// them along with their stored parts, and Run sweeps away abandoned ones.
+type Uploads struct {
+	DB      repository.DatabaseRepo
+	Storage repository.BlobStorage
+}
+
+// Delete deletes an upload and the parts stored for it so far.
+func (u *Uploads) Delete(ctx context.Context, upload *models.Upload) error {
+	for _, key := range upload.Parts {
+		err := u.Storage.Delete(ctx, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return u.DB.DeleteUpload(upload.ID)
+}
+
+// DeleteExpired deletes every upload past its expiry time, and returns how many there
+// were.
+func (u *Uploads) DeleteExpired(ctx context.Context) (int, error) {
+	uploads, err := u.DB.ExpiredUploads(time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	for i, upload := range uploads {
+		err := u.Delete(ctx, upload)
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(uploads), nil
+}
+
+// Run deletes expired uploads every interval until ctx is cancelled.
+func (u *Uploads) Run(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				n, err := u.DeleteExpired(ctx)
+				if err != nil {
+					log.Printf("uploads: deleting expired uploads: %v", err)
+				}
+				if n > 0 {
+					log.Printf("uploads: deleted %d expired uploads", n)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,189 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/sdblg/meme/pkg/imaging"
+	"github.com/sdblg/meme/pkg/models"
+	"github.com/sdblg/meme/pkg/repository"
+)
+
+// VariantWidths are the widths, in pixels, that resized copies of each meme image are
+// generated at. Widths larger than the original are skipped.
+var VariantWidths = []int{160, 480, 1080}
+
+// Variants generates resized copies of meme images. Uploads Enqueue a meme and return
+// straight away; Run processes the queue in the background.
+//
+// If Watermark is set, it is drawn onto a full size copy of the image and the variants of
+// every meme that has not had it turned off.
+type Variants struct {
+	DB        repository.DatabaseRepo
+	Storage   repository.BlobStorage
+	Watermark *imaging.Watermark
+	queue     chan int
+}
+
+// NewVariants returns a Variants whose queue holds up to queueSize pending memes.
+func NewVariants(
+	db repository.DatabaseRepo,
+	storage repository.BlobStorage,
+	queueSize int,
+) *Variants {
+	return &Variants{
+		DB:      db,
+		Storage: storage,
+		queue:   make(chan int, queueSize),
+	}
+}
+
+// Enqueue schedules variant generation for a meme. It never blocks: if the queue is full
+// the meme is skipped, and its variants can be regenerated later with memectl.
+func (v *Variants) Enqueue(id int) {
+	select {
+	case v.queue <- id:
+	default:
+		log.Printf("variants: queue full, skipping meme %d", id)
+	}
+}
+
+// Run processes queued memes with the given number of workers until ctx is cancelled.
+func (v *Variants) Run(ctx context.Context, workers int) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case id := <-v.queue:
+					err := v.Generate(ctx, id)
+					if err != nil {
+						log.Printf("variants: meme %d: %v", id, err)
+					}
+				}
+			}
+		}()
+	}
+}
+
+// Generate resizes one meme's image to each of VariantWidths, stores the results under
+// variants/ and records their paths on the meme, replacing any previous variants.
+// Animated images are resized frame by frame into animated GIFs. Watermarked memes also
+// get a full size copy of their image, which clients are sent instead of the image
+// itself, and their variants and that copy have the watermark drawn on every frame.
+func (v *Variants) Generate(ctx context.Context, id int) error {
+	meme, err := v.DB.OneMeme(id)
+	if err != nil {
+		return err
+	}
+
+	key := meme.ImageKey()
+
+	blob, err := v.Storage.Get(ctx, key)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", key, err)
+	}
+	data, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", key, err)
+	}
+
+	info, err := imaging.Probe(data)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", key, err)
+	}
+
+	var img image.Image
+	var format string
+
+	if !info.Animated() {
+		img, format, err = imaging.Decode(data)
+		if err != nil {
+			return fmt.Errorf("decoding %s: %w", key, err)
+		}
+		info.Width = img.Bounds().Dx()
+	}
+
+	// Watermarked variants are stored under their own keys, named after the watermark,
+	// since the same image may be watermarked differently or not at all.
+	var mark *imaging.Watermark
+	var suffix string
+	if v.Watermark != nil && meme.Watermarked() {
+		mark = v.Watermark
+		suffix = "_w" + mark.Fingerprint()
+	}
+
+	render := func(frame image.Image, width int) image.Image {
+		resized := imaging.Resize(frame, width)
+		if mark != nil {
+			return mark.Apply(resized)
+		}
+		return resized
+	}
+
+	base := strings.TrimSuffix(key, path.Ext(key))
+
+	// store renders the image at width and stores it, returning its path.
+	store := func(width int) (string, error) {
+		var (
+			out              []byte
+			contentType, ext string
+			err              error
+		)
+
+		if info.Animated() {
+			out, contentType, ext, err = imaging.RenderAnimation(
+				data,
+				func(frame image.Image) image.Image {
+					return render(frame, width)
+				},
+			)
+		} else {
+			out, contentType, ext, err = imaging.Encode(render(img, width), format)
+		}
+		if err != nil {
+			return "", err
+		}
+
+		variantKey := fmt.Sprintf("variants/%s_%d%s%s", base, width, suffix, ext)
+
+		err = v.Storage.Put(ctx, variantKey, bytes.NewReader(out), int64(len(out)), contentType)
+		if err != nil {
+			return "", fmt.Errorf("storing %s: %w", variantKey, err)
+		}
+
+		return models.ImagePath(variantKey), nil
+	}
+
+	variants := make(map[string]string)
+
+	for _, width := range VariantWidths {
+		if width >= info.Width {
+			continue
+		}
+
+		variants[strconv.Itoa(width)], err = store(width)
+		if err != nil {
+			return err
+		}
+	}
+
+	var watermarked string
+	if mark != nil {
+		watermarked, err = store(info.Width)
+		if err != nil {
+			return err
+		}
+	}
+
+	return v.DB.UpdateMemeVariants(id, variants, watermarked)
+}
@@ -7,12 +7,20 @@ import (
 	"net/http"
 )
 
+const (
+	ContentTypeJSON    = "application/json"
+	ContentTypeGeoJSON = "application/geo+json"
+)
+
 type JSONResponse struct {
 	Error   bool        `json:"error"`
 	Message string      `json:"message"`
 	Data    interface{} `json:"data,omitempty"`
 }
 
+// WriteJSON marshals data and writes it with the given status. The response is sent as
+// application/json unless the optional headers set a Content-Type of their own, such as
+// ContentTypeGeoJSON.
 func WriteJSON(w http.ResponseWriter, status int, data interface{}, headers ...http.Header) error {
 	out, err := json.Marshal(data)
 	if err != nil {
@@ -25,7 +33,9 @@ func WriteJSON(w http.ResponseWriter, status int, data interface{}, headers ...h
 		}
 	}
 
-	w.Header().Set("Content-Type", "Application/json")
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", ContentTypeJSON)
+	}
 	w.WriteHeader(status)
 	_, err = w.Write(out)
 	if err != nil {
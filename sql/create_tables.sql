@@ -16,6 +16,76 @@ SET xmloption = content;
 SET client_min_messages = warning;
 SET row_security = off;
 
+--
+-- Name: cube; Type: EXTENSION; Schema: -; Owner: -
+--
+
+CREATE EXTENSION IF NOT EXISTS cube WITH SCHEMA public;
+
+
+--
+-- Name: earthdistance; Type: EXTENSION; Schema: -; Owner: -
+--
+
+CREATE EXTENSION IF NOT EXISTS earthdistance WITH SCHEMA public;
+
+--
+-- Name: meme_search_vector(integer, text, text, text); Type: FUNCTION; Schema: public; Owner: -
+--
+
+CREATE FUNCTION public.meme_search_vector(integer, text, text, text) RETURNS tsvector
+    LANGUAGE sql STABLE
+    AS $_$
+    SELECT setweight(to_tsvector('english', coalesce($2, '')), 'A')
+        || setweight(to_tsvector('english', coalesce((
+            SELECT string_agg(tags.name, ' ')
+            FROM public.meme_tags JOIN public.tags ON tags.id = meme_tags.tag_id
+            WHERE meme_tags.meme_id = $1
+        ), '')), 'B')
+        || setweight(to_tsvector('english', coalesce($3, '')), 'C')
+        || setweight(to_tsvector('english', coalesce($4, '')), 'D')
+$_$;
+
+
+--
+-- Name: meme_tags_search_trigger(); Type: FUNCTION; Schema: public; Owner: -
+--
+
+CREATE FUNCTION public.meme_tags_search_trigger() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+DECLARE
+    changed_id integer;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        changed_id := OLD.meme_id;
+    ELSE
+        changed_id := NEW.meme_id;
+    END IF;
+
+    UPDATE public.memes
+    SET search = public.meme_search_vector(id, title, caption, alt_text)
+    WHERE id = changed_id;
+
+    RETURN NULL;
+END
+$$;
+
+
+--
+-- Name: memes_search_trigger(); Type: FUNCTION; Schema: public; Owner: -
+--
+
+CREATE FUNCTION public.memes_search_trigger() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    NEW.search := public.meme_search_vector(NEW.id, NEW.title, NEW.caption, NEW.alt_text);
+    RETURN NEW;
+END
+$$;
+
+
 SET default_tablespace = '';
 
 SET default_table_access_method = heap;
@@ -26,12 +96,33 @@ SET default_table_access_method = heap;
 --
 
 CREATE TABLE public.memes (
-    id integer NOT NULL,   
-    lat character varying(512),
-    lon character varying(512),
+    id integer NOT NULL,
+    lat double precision NOT NULL,
+    lon double precision NOT NULL,
     image character varying(255),
+    variants jsonb DEFAULT '{}'::jsonb NOT NULL,
+    captured_at timestamp without time zone,
+    phash bigint,
+    duplicate_of integer,
+    media_type character varying(64),
+    width integer,
+    height integer,
+    frame_count integer DEFAULT 1 NOT NULL,
+    duration_ms integer DEFAULT 0 NOT NULL,
+    visibility character varying(16) DEFAULT 'public'::character varying NOT NULL,
+    blurhash character varying(64),
+    watermark boolean DEFAULT true NOT NULL,
+    watermarked_image character varying(255),
+    title character varying(255),
+    caption text,
+    alt_text text,
+    search tsvector,
+    owner_id integer,
     created_at timestamp without time zone,
-    updated_at timestamp without time zone
+    updated_at timestamp without time zone,
+    CONSTRAINT memes_lat_check CHECK (((lat >= ('-90'::integer)::double precision) AND (lat <= (90)::double precision))),
+    CONSTRAINT memes_lon_check CHECK (((lon >= ('-180'::integer)::double precision) AND (lon <= (180)::double precision))),
+    CONSTRAINT memes_visibility_check CHECK (((visibility)::text = ANY ((ARRAY['public'::character varying, 'private'::character varying, 'pending'::character varying])::text[])))
 );
 
 ALTER TABLE public.memes OWNER TO esusu;
@@ -49,6 +140,112 @@ ALTER TABLE public.memes ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
 );
 
 
+--
+-- Name: meme_templates; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.meme_templates (
+    id integer NOT NULL,
+    name character varying(255) NOT NULL,
+    image character varying(255) NOT NULL,
+    width integer NOT NULL,
+    height integer NOT NULL,
+    boxes jsonb DEFAULT '[]'::jsonb NOT NULL,
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
+
+ALTER TABLE public.meme_templates OWNER TO esusu;
+
+--
+-- Name: meme_templates_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.meme_templates ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.meme_templates_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: tags; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.tags (
+    id integer NOT NULL,
+    name character varying(64) NOT NULL
+);
+
+ALTER TABLE public.tags OWNER TO esusu;
+
+--
+-- Name: tags_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.tags ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.tags_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: meme_tags; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.meme_tags (
+    meme_id integer NOT NULL,
+    tag_id integer NOT NULL
+);
+
+ALTER TABLE public.meme_tags OWNER TO esusu;
+
+
+--
+-- Name: uploads; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.uploads (
+    id character varying(32) NOT NULL,
+    length bigint NOT NULL,
+    upload_offset bigint DEFAULT 0 NOT NULL,
+    metadata jsonb DEFAULT '{}'::jsonb NOT NULL,
+    parts jsonb DEFAULT '[]'::jsonb NOT NULL,
+    meme_id integer,
+    owner_id integer,
+    expires_at timestamp without time zone NOT NULL,
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone,
+    CONSTRAINT uploads_offset_check CHECK (((upload_offset >= 0) AND (upload_offset <= length)))
+);
+
+ALTER TABLE public.uploads OWNER TO esusu;
+
+
+--
+-- Name: user_tokens; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.user_tokens (
+    token_hash character(64) NOT NULL,
+    user_id integer NOT NULL,
+    purpose character varying(32) NOT NULL,
+    password character varying(255),
+    expires_at timestamp without time zone NOT NULL,
+    used_at timestamp without time zone,
+    created_at timestamp without time zone
+);
+
+ALTER TABLE public.user_tokens OWNER TO esusu;
+
+
 --
 -- Name: users; Type: TABLE; Schema: public; Owner: -
 --
@@ -59,8 +256,12 @@ CREATE TABLE public.users (
     last_name character varying(255),
     email character varying(255),
     password character varying(255),
+    role character varying(16) DEFAULT 'member'::character varying NOT NULL,
+    email_verified_at timestamp without time zone,
+    token_version integer DEFAULT 0 NOT NULL,
     created_at timestamp without time zone,
-    updated_at timestamp without time zone
+    updated_at timestamp without time zone,
+    CONSTRAINT users_role_check CHECK (((role)::text = ANY ((ARRAY['admin'::character varying, 'moderator'::character varying, 'member'::character varying])::text[])))
 );
 
 ALTER TABLE public.users OWNER TO esusu;
@@ -83,19 +284,31 @@ ALTER TABLE public.users ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
 --
 
 COPY public.memes (id, lat, lon, image, created_at, updated_at) FROM stdin;
-1	40.730610   -73.935242    /8Z8dptJEypuLoOQro1WugD855YE.jpg	2024-03-13 00:00:00	2024-03-13 00:00:00
-2	40.730610   -73.935242    /ceG9VzoRAVGwivFU403Wc3AHRys.jpg	2024-03-13 00:00:00	2024-03-13 00:00:00
-3	40.730610   -73.935242    /3bhkrj58Vtu7enYsRolD1fZdja1.jpg	2024-03-13 00:00:00	2024-03-13 00:00:00
+1	40.730610	-73.935242	/8Z8dptJEypuLoOQro1WugD855YE.jpg	2024-03-13 00:00:00	2024-03-13 00:00:00
+2	40.730610	-73.935242	/ceG9VzoRAVGwivFU403Wc3AHRys.jpg	2024-03-13 00:00:00	2024-03-13 00:00:00
+3	40.730610	-73.935242	/3bhkrj58Vtu7enYsRolD1fZdja1.jpg	2024-03-13 00:00:00	2024-03-13 00:00:00
 \.
 
 --
 -- Data for Name: users; Type: TABLE DATA; Schema: public; Owner: -
 --
 
-COPY public.users (id, first_name, last_name, email, password, created_at, updated_at) FROM stdin;
-1	Admin	User	admin@esusu.com	$2a$14$wVsaPvJnJJsomWArouWCtusem6S/.Gauq/GjOIEHpyh2DAMmso1wy	2022-09-23 00:00:00	2022-09-23 00:00:00
+COPY public.users (id, first_name, last_name, email, password, role, email_verified_at, token_version, created_at, updated_at) FROM stdin;
+1	Admin	User	admin@esusu.com	$2a$14$wVsaPvJnJJsomWArouWCtusem6S/.Gauq/GjOIEHpyh2DAMmso1wy	admin	2022-09-23 00:00:00	0	2022-09-23 00:00:00	2022-09-23 00:00:00
 \.
 
+--
+-- Name: memes_id_seq; Type: SEQUENCE SET; Schema: public; Owner: -
+--
+
+SELECT pg_catalog.setval('public.memes_id_seq', (SELECT max(id) FROM public.memes), true);
+
+--
+-- Name: users_id_seq; Type: SEQUENCE SET; Schema: public; Owner: -
+--
+
+SELECT pg_catalog.setval('public.users_id_seq', 1, true);
+
 --
 -- Name: memes memes_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -104,6 +317,53 @@ ALTER TABLE ONLY public.memes
     ADD CONSTRAINT memes_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: meme_templates meme_templates_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.meme_templates
+    ADD CONSTRAINT meme_templates_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: tags tags_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.tags
+    ADD CONSTRAINT tags_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: tags tags_name_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.tags
+    ADD CONSTRAINT tags_name_key UNIQUE (name);
+
+
+--
+-- Name: meme_tags meme_tags_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.meme_tags
+    ADD CONSTRAINT meme_tags_pkey PRIMARY KEY (meme_id, tag_id);
+
+
+--
+-- Name: uploads uploads_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.uploads
+    ADD CONSTRAINT uploads_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: user_tokens user_tokens_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.user_tokens
+    ADD CONSTRAINT user_tokens_pkey PRIMARY KEY (token_hash);
+
 --
 -- Name: users users_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -111,6 +371,126 @@ ALTER TABLE ONLY public.memes
 ALTER TABLE ONLY public.users
     ADD CONSTRAINT users_pkey PRIMARY KEY (id);
 
+--
+-- Name: memes memes_duplicate_of_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.memes
+    ADD CONSTRAINT memes_duplicate_of_fkey FOREIGN KEY (duplicate_of) REFERENCES public.memes(id) ON DELETE SET NULL;
+
+--
+-- Name: memes memes_owner_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.memes
+    ADD CONSTRAINT memes_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES public.users(id) ON DELETE SET NULL;
+
+--
+-- Name: meme_tags meme_tags_meme_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.meme_tags
+    ADD CONSTRAINT meme_tags_meme_id_fkey FOREIGN KEY (meme_id) REFERENCES public.memes(id) ON DELETE CASCADE;
+
+--
+-- Name: meme_tags meme_tags_tag_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.meme_tags
+    ADD CONSTRAINT meme_tags_tag_id_fkey FOREIGN KEY (tag_id) REFERENCES public.tags(id) ON DELETE CASCADE;
+
+--
+-- Name: uploads uploads_meme_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.uploads
+    ADD CONSTRAINT uploads_meme_id_fkey FOREIGN KEY (meme_id) REFERENCES public.memes(id) ON DELETE SET NULL;
+
+--
+-- Name: uploads uploads_owner_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.uploads
+    ADD CONSTRAINT uploads_owner_id_fkey FOREIGN KEY (owner_id) REFERENCES public.users(id) ON DELETE CASCADE;
+
+--
+-- Name: user_tokens user_tokens_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.user_tokens
+    ADD CONSTRAINT user_tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON DELETE CASCADE;
+
+--
+-- Name: memes_location_idx; Type: INDEX; Schema: public; Owner: -
+--
+-- earthdistance's SQL functions resolve cube() and earth() through the search_path,
+-- so it has to include public while the index is built.
+--
+
+SELECT pg_catalog.set_config('search_path', 'public', false);
+
+CREATE INDEX memes_location_idx ON public.memes USING gist (public.ll_to_earth(lat, lon));
+
+--
+-- Name: memes_lat_lon_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX memes_lat_lon_idx ON public.memes USING btree (lat, lon);
+
+--
+-- Name: memes_image_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX memes_image_idx ON public.memes USING btree (image varchar_pattern_ops);
+
+--
+-- Name: memes_owner_id_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX memes_owner_id_idx ON public.memes USING btree (owner_id);
+
+--
+-- Name: meme_tags_tag_id_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX meme_tags_tag_id_idx ON public.meme_tags USING btree (tag_id);
+
+--
+-- Name: memes_search_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX memes_search_idx ON public.memes USING gin (search);
+
+--
+-- Name: uploads_expires_at_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX uploads_expires_at_idx ON public.uploads USING btree (expires_at);
+
+--
+-- Name: user_tokens_user_id_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX user_tokens_user_id_idx ON public.user_tokens USING btree (user_id, purpose);
+
+--
+-- Name: users_email_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE UNIQUE INDEX users_email_idx ON public.users USING btree (lower((email)::text));
+
+--
+-- Name: meme_tags meme_tags_search; Type: TRIGGER; Schema: public; Owner: -
+--
+
+CREATE TRIGGER meme_tags_search AFTER INSERT OR DELETE ON public.meme_tags FOR EACH ROW EXECUTE FUNCTION public.meme_tags_search_trigger();
+
+--
+-- Name: memes memes_search; Type: TRIGGER; Schema: public; Owner: -
+--
+
+CREATE TRIGGER memes_search BEFORE INSERT OR UPDATE OF title, caption, alt_text ON public.memes FOR EACH ROW EXECUTE FUNCTION public.memes_search_trigger();
+
 --
 -- PostgreSQL database dump complete
 --
@@ -0,0 +1,12 @@
+--
+-- Proximity search for GET /memes/nearby.
+--
+-- cube and earthdistance ship with the standard Postgres contrib modules. The GiST
+-- index lets earth_box() prefilter candidates without scanning the whole table.
+--
+
+CREATE EXTENSION IF NOT EXISTS cube WITH SCHEMA public;
+CREATE EXTENSION IF NOT EXISTS earthdistance WITH SCHEMA public;
+
+CREATE INDEX IF NOT EXISTS memes_location_idx
+    ON public.memes USING gist (ll_to_earth(lat::double precision, lon::double precision));
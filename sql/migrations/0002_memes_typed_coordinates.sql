@@ -0,0 +1,42 @@
+--
+-- Store meme coordinates as double precision instead of varchar(512).
+--
+-- Every existing lat/lon must already parse as a number in range; if any row does not,
+-- the migration aborts and lists the offending ids so they can be fixed by hand first.
+--
+
+BEGIN;
+
+DO $$
+DECLARE
+    bad integer[];
+BEGIN
+    SELECT array_agg(id ORDER BY id) INTO bad
+    FROM public.memes
+    WHERE CASE
+        WHEN coalesce(btrim(lat), '') ~ '^[-+]?([0-9]+\.?[0-9]*|\.[0-9]+)$'
+         AND coalesce(btrim(lon), '') ~ '^[-+]?([0-9]+\.?[0-9]*|\.[0-9]+)$'
+        THEN btrim(lat)::double precision NOT BETWEEN -90 AND 90
+          OR btrim(lon)::double precision NOT BETWEEN -180 AND 180
+        ELSE true
+    END;
+
+    IF bad IS NOT NULL THEN
+        RAISE EXCEPTION 'memes with invalid coordinates: %', bad;
+    END IF;
+END
+$$;
+
+DROP INDEX IF EXISTS public.memes_location_idx;
+
+ALTER TABLE public.memes
+    ALTER COLUMN lat TYPE double precision USING btrim(lat)::double precision,
+    ALTER COLUMN lon TYPE double precision USING btrim(lon)::double precision,
+    ALTER COLUMN lat SET NOT NULL,
+    ALTER COLUMN lon SET NOT NULL,
+    ADD CONSTRAINT memes_lat_check CHECK (lat BETWEEN -90 AND 90),
+    ADD CONSTRAINT memes_lon_check CHECK (lon BETWEEN -180 AND 180);
+
+CREATE INDEX memes_location_idx ON public.memes USING gist (ll_to_earth(lat, lon));
+
+COMMIT;
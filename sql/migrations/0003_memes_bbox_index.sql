@@ -0,0 +1,5 @@
+--
+-- Viewport queries for GET /memes?bbox=.. filter on lat and lon ranges.
+--
+
+CREATE INDEX IF NOT EXISTS memes_lat_lon_idx ON public.memes USING btree (lat, lon);
@@ -0,0 +1,8 @@
+--
+-- Resized image variants, keyed by width in pixels.
+--
+-- Existing memes get an empty map; run `memectl variants` to generate theirs.
+--
+
+ALTER TABLE public.memes
+    ADD COLUMN variants jsonb DEFAULT '{}'::jsonb NOT NULL;
@@ -0,0 +1,6 @@
+--
+-- When an uploaded photo was originally taken, read from its EXIF data.
+--
+
+ALTER TABLE public.memes
+    ADD COLUMN captured_at timestamp without time zone;
@@ -0,0 +1,11 @@
+--
+-- Perceptual hashes for duplicate detection (GET /memes/{id}/similar).
+--
+-- phash is a 64-bit dHash; the Hamming distance between two hashes is
+-- bit_count((a # b)::bit(64)), which needs Postgres 14 or later. duplicate_of records the
+-- earlier meme an upload was flagged as a repost of.
+--
+
+ALTER TABLE public.memes
+    ADD COLUMN phash bigint,
+    ADD COLUMN duplicate_of integer REFERENCES public.memes(id) ON DELETE SET NULL;
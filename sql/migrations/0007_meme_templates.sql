@@ -0,0 +1,17 @@
+--
+-- Meme templates (POST /memes/generate).
+--
+-- A template is a base image with named text boxes, stored as a jsonb array of
+-- {name, x, y, width, height, font_size, align, color, stroke_color, stroke_width, uppercase}.
+--
+
+CREATE TABLE public.meme_templates (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    name character varying(255) NOT NULL,
+    image character varying(255) NOT NULL,
+    width integer NOT NULL,
+    height integer NOT NULL,
+    boxes jsonb DEFAULT '[]'::jsonb NOT NULL,
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
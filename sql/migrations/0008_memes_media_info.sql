@@ -0,0 +1,13 @@
+--
+-- Media type, size and animation timing of meme images.
+--
+-- Existing memes are treated as stills of unknown type and size; media_type, width and
+-- height stay null until the image is uploaded again.
+--
+
+ALTER TABLE public.memes
+    ADD COLUMN media_type character varying(64),
+    ADD COLUMN width integer,
+    ADD COLUMN height integer,
+    ADD COLUMN frame_count integer DEFAULT 1 NOT NULL,
+    ADD COLUMN duration_ms integer DEFAULT 0 NOT NULL;
@@ -0,0 +1,25 @@
+--
+-- Images are served by the API under /images/ (GET /images/{key}).
+--
+-- Memes, variants and templates uploaded so far were stored with the bare storage key as
+-- their path. Seed rows whose images live on another host are left alone.
+--
+
+UPDATE public.memes
+    SET image = '/images' || image
+    WHERE image ~ '^/[0-9a-f]{64}\.[a-z]+$';
+
+UPDATE public.memes
+    SET variants = (
+        SELECT jsonb_object_agg(width, '/images' || path)
+        FROM jsonb_each_text(variants) AS v(width, path)
+    )
+    WHERE variants <> '{}'::jsonb
+        AND NOT EXISTS (
+            SELECT 1 FROM jsonb_each_text(variants) AS v(width, path)
+            WHERE path LIKE '/images/%'
+        );
+
+UPDATE public.meme_templates
+    SET image = '/images' || image
+    WHERE image LIKE '/templates/%';
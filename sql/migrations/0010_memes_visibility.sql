@@ -0,0 +1,13 @@
+--
+-- Meme visibility, and signed image URLs for memes that are not public.
+--
+-- Only public memes are listed. GET /images/{key} looks memes up by image path prefix to
+-- decide whether an unsigned request may be served, hence the pattern index.
+--
+
+ALTER TABLE public.memes
+    ADD COLUMN visibility character varying(16) DEFAULT 'public' NOT NULL,
+    ADD CONSTRAINT memes_visibility_check
+        CHECK (visibility IN ('public', 'private', 'pending'));
+
+CREATE INDEX memes_image_idx ON public.memes USING btree (image varchar_pattern_ops);
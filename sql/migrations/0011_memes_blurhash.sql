@@ -0,0 +1,8 @@
+--
+-- BlurHash placeholders of meme images.
+--
+-- Existing memes have none until `memectl blurhash` is run to backfill them.
+--
+
+ALTER TABLE public.memes
+    ADD COLUMN blurhash character varying(64);
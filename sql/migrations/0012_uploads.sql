@@ -0,0 +1,21 @@
+--
+-- Resumable uploads (tus protocol, /admin/uploads).
+--
+-- parts is a jsonb array of the blob storage keys holding the bytes received so far, in
+-- order. Uploads past expires_at are abandoned and deleted, with their parts, by the API.
+--
+
+CREATE TABLE public.uploads (
+    id character varying(32) PRIMARY KEY,
+    length bigint NOT NULL,
+    upload_offset bigint DEFAULT 0 NOT NULL,
+    metadata jsonb DEFAULT '{}'::jsonb NOT NULL,
+    parts jsonb DEFAULT '[]'::jsonb NOT NULL,
+    meme_id integer REFERENCES public.memes(id) ON DELETE SET NULL,
+    expires_at timestamp without time zone NOT NULL,
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone,
+    CONSTRAINT uploads_offset_check CHECK (upload_offset >= 0 AND upload_offset <= length)
+);
+
+CREATE INDEX uploads_expires_at_idx ON public.uploads USING btree (expires_at);
@@ -0,0 +1,8 @@
+--
+-- Per meme switch for the watermark drawn on image variants.
+--
+-- Existing variants stay as they are until regenerated with `memectl variants`.
+--
+
+ALTER TABLE public.memes
+    ADD COLUMN watermark boolean DEFAULT true NOT NULL;
@@ -0,0 +1,23 @@
+--
+-- Titles, captions, alt text and tags of memes (GET /tags, GET /tags/{tag}/memes).
+--
+-- Tag names are stored normalised: lower case, without a leading #, with dashes for spaces.
+--
+
+ALTER TABLE public.memes
+    ADD COLUMN title character varying(255),
+    ADD COLUMN caption text,
+    ADD COLUMN alt_text text;
+
+CREATE TABLE public.tags (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    name character varying(64) NOT NULL UNIQUE
+);
+
+CREATE TABLE public.meme_tags (
+    meme_id integer NOT NULL REFERENCES public.memes(id) ON DELETE CASCADE,
+    tag_id integer NOT NULL REFERENCES public.tags(id) ON DELETE CASCADE,
+    PRIMARY KEY (meme_id, tag_id)
+);
+
+CREATE INDEX meme_tags_tag_id_idx ON public.meme_tags USING btree (tag_id);
@@ -0,0 +1,60 @@
+--
+-- Full-text search over meme titles, tags, captions and alt text (GET /memes/search).
+--
+-- memes.search is kept up to date by triggers, since it draws on the meme's tags as well as
+-- its own columns. Matches in the title rank highest, then tags, captions and alt text.
+--
+
+CREATE FUNCTION public.meme_search_vector(integer, text, text, text) RETURNS tsvector
+    LANGUAGE sql STABLE
+    AS $_$
+    SELECT setweight(to_tsvector('english', coalesce($2, '')), 'A')
+        || setweight(to_tsvector('english', coalesce((
+            SELECT string_agg(tags.name, ' ')
+            FROM public.meme_tags JOIN public.tags ON tags.id = meme_tags.tag_id
+            WHERE meme_tags.meme_id = $1
+        ), '')), 'B')
+        || setweight(to_tsvector('english', coalesce($3, '')), 'C')
+        || setweight(to_tsvector('english', coalesce($4, '')), 'D')
+$_$;
+
+CREATE FUNCTION public.memes_search_trigger() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    NEW.search := public.meme_search_vector(NEW.id, NEW.title, NEW.caption, NEW.alt_text);
+    RETURN NEW;
+END
+$$;
+
+CREATE FUNCTION public.meme_tags_search_trigger() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+DECLARE
+    changed_id integer;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        changed_id := OLD.meme_id;
+    ELSE
+        changed_id := NEW.meme_id;
+    END IF;
+
+    UPDATE public.memes
+    SET search = public.meme_search_vector(id, title, caption, alt_text)
+    WHERE id = changed_id;
+
+    RETURN NULL;
+END
+$$;
+
+ALTER TABLE public.memes ADD COLUMN search tsvector;
+
+UPDATE public.memes SET search = public.meme_search_vector(id, title, caption, alt_text);
+
+CREATE INDEX memes_search_idx ON public.memes USING gin (search);
+
+CREATE TRIGGER memes_search BEFORE INSERT OR UPDATE OF title, caption, alt_text ON public.memes
+    FOR EACH ROW EXECUTE FUNCTION public.memes_search_trigger();
+
+CREATE TRIGGER meme_tags_search AFTER INSERT OR DELETE ON public.meme_tags
+    FOR EACH ROW EXECUTE FUNCTION public.meme_tags_search_trigger();
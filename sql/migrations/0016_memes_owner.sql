@@ -0,0 +1,21 @@
+--
+-- Meme ownership (GET /users/{id}/memes).
+--
+-- Only a meme's owner or an admin may update or delete it. Every user could change every
+-- meme before, so existing users are made admins; memes created before now have no owner,
+-- and are left to admins. Resumable uploads record who started them, who alone may
+-- continue them.
+--
+
+ALTER TABLE public.users
+    ADD COLUMN is_admin boolean DEFAULT false NOT NULL;
+
+UPDATE public.users SET is_admin = true;
+
+ALTER TABLE public.memes
+    ADD COLUMN owner_id integer REFERENCES public.users(id) ON DELETE SET NULL;
+
+CREATE INDEX memes_owner_id_idx ON public.memes USING btree (owner_id);
+
+ALTER TABLE public.uploads
+    ADD COLUMN owner_id integer REFERENCES public.users(id) ON DELETE CASCADE;
@@ -0,0 +1,13 @@
+--
+-- User roles: admin, moderator and member, carried in access tokens.
+--
+-- Replaces users.is_admin: admins stay admins, and everyone else becomes a member.
+--
+
+ALTER TABLE public.users
+    ADD COLUMN role character varying(16) DEFAULT 'member' NOT NULL,
+    ADD CONSTRAINT users_role_check CHECK (role IN ('admin', 'moderator', 'member'));
+
+UPDATE public.users SET role = 'admin' WHERE is_admin;
+
+ALTER TABLE public.users DROP COLUMN is_admin;
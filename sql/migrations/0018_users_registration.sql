@@ -0,0 +1,25 @@
+--
+-- Self-service registration with email verification (POST /register, GET /verify-email).
+--
+-- Users may only log in once their email address is verified. Existing users were created
+-- by hand, so they count as verified. Email addresses are unique regardless of case.
+-- user_tokens holds the hashes of single-use secrets emailed to users.
+--
+
+ALTER TABLE public.users
+    ADD COLUMN email_verified_at timestamp without time zone;
+
+UPDATE public.users SET email_verified_at = coalesce(created_at, now());
+
+CREATE UNIQUE INDEX users_email_idx ON public.users USING btree (lower((email)::text));
+
+CREATE TABLE public.user_tokens (
+    token_hash character(64) PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    purpose character varying(32) NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    used_at timestamp without time zone,
+    created_at timestamp without time zone
+);
+
+CREATE INDEX user_tokens_user_id_idx ON public.user_tokens USING btree (user_id, purpose);
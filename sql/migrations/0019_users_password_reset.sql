@@ -0,0 +1,10 @@
+--
+-- Password reset (POST /password/forgot, POST /password/reset).
+--
+-- Reset links are single-use user_tokens with the reset_password purpose. Refresh tokens
+-- carry the user's token_version, and resetting a password increments it, so that every
+-- refresh token issued before the reset stops working.
+--
+
+ALTER TABLE public.users
+    ADD COLUMN token_version integer DEFAULT 0 NOT NULL;
@@ -0,0 +1,12 @@
+--
+-- Email verification links set the password they were registered with.
+--
+-- Registering again with an unverified address no longer replaces the password, which
+-- would let anyone who registers the address right after its owner choose the password of
+-- the account the owner then verifies. Instead each verification token records the bcrypt
+-- hash of the password it was registered with, and following the link sets it. Tokens
+-- issued before this migration have none, and leave the password alone.
+--
+
+ALTER TABLE public.user_tokens
+    ADD COLUMN password character varying(255);
@@ -0,0 +1,11 @@
+--
+-- Full size watermarked copies of meme images.
+--
+-- Watermarked memes are sent with the path of a watermarked copy of their image, under
+-- variants/, instead of the image itself, which is no longer served without a signed URL
+-- while a watermark is configured. Run `memectl variants` after migrating to generate the
+-- copies for existing memes; until then their images are not served.
+--
+
+ALTER TABLE public.memes
+    ADD COLUMN watermarked_image character varying(255);